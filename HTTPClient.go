@@ -3,11 +3,14 @@ package rpc
 import (
 	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+
+	"github.com/namitos/rpc/codec"
+	"github.com/namitos/rpc/packets"
 )
 
 type HTTPClient struct {
@@ -16,6 +19,16 @@ type HTTPClient struct {
 	Password  string
 	Proxy     string
 	Transport *http.Transport
+	// Metrics counts traffic when set
+	Metrics *Metrics
+	// MaxBodySize limits responses, DefaultMaxMessageSize when 0
+	MaxBodySize int64
+	// Compression gzips requests from CompressionThreshold bytes, DefaultCompressionThreshold when 0,
+	// and asks for gzipped responses
+	Compression          bool
+	CompressionThreshold int
+	// Codec encodes requests, JSON when nil; responses are decoded by their Content-Type
+	Codec codec.Codec
 }
 
 func (h *HTTPClient) Call(ctx context.Context, input []Input, result *[]Output) error {
@@ -27,15 +40,42 @@ func (h *HTTPClient) CallSingle(ctx context.Context, method string, params any,
 }
 
 func (h *HTTPClient) call(ctx context.Context, input, result any) error {
-	body, err := json.Marshal(input)
+	c := h.Codec
+	if c == nil {
+		c = codec.JSON
+	}
+	body, err := c.Marshal(input)
 	if err != nil {
 		return err
 	}
+	compressed := h.Compression && len(body) >= compressionThreshold(h.CompressionThreshold)
+	if compressed {
+		if body, err = gzipCompress(body); err != nil {
+			return err
+		}
+	}
 	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
-	req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	if c == codec.JSON {
+		req.Header.Add("Content-Type", "application/json; charset=utf-8")
+	} else {
+		req.Header.Add("Content-Type", c.ContentType())
+		req.Header.Add("Accept", c.ContentType())
+	}
+	if h.Compression {
+		req.Header.Set("Accept-Encoding", CompressionGzip)
+	}
+	if compressed {
+		req.Header.Set("Content-Encoding", CompressionGzip)
+	}
+	if tc, ok := TraceFromContext(ctx); ok {
+		req.Header.Set(HeaderTraceparent, tc.Traceparent())
+		if tc.State != "" {
+			req.Header.Set(HeaderTracestate, tc.State)
+		}
+	}
 	if h.Username != "" && h.Password != "" {
 		req.SetBasicAuth(h.Username, h.Password)
 	}
@@ -55,18 +95,48 @@ func (h *HTTPClient) call(ctx context.Context, input, result any) error {
 	httpClient := &http.Client{Transport: transport}
 	res, err := httpClient.Do(req)
 	if err != nil {
+		if ctx.Err() != nil {
+			return contextError(ctx)
+		}
 		return err
 	}
+	h.Metrics.add(metricClientSent, float64(len(body)), TransportHTTP)
 	defer res.Body.Close()
-	body, err = io.ReadAll(res.Body)
+	maxBodySize := h.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxMessageSize
+	}
+	resBody := &countingReader{r: res.Body}
+	if res.Header.Get("Content-Encoding") == CompressionGzip {
+		body, err = gzipDecompress(resBody, uint64(maxBodySize))
+	} else {
+		body, err = io.ReadAll(io.LimitReader(resBody, maxBodySize+1))
+		if err == nil && int64(len(body)) > maxBodySize {
+			err = packets.ErrTooLarge
+		}
+	}
+	h.Metrics.add(metricClientReceived, float64(resBody.n), TransportHTTP)
+	if errors.Is(err, packets.ErrTooLarge) {
+		return fmt.Errorf("response body exceeds %v bytes", maxBodySize)
+	}
 	if err != nil {
 		return err
 	}
+	if resCodec := codec.ByContentType(res.Header.Get("Content-Type")); resCodec != nil {
+		c = resCodec
+	}
 	if res.StatusCode != 200 {
+		output := &Output{}
+		if c.Unmarshal(body, output) == nil && output.Error != nil {
+			return output.Error
+		}
 		return fmt.Errorf("%v %v", res.StatusCode, string(body))
 	}
-	if err := json.Unmarshal(body, result); err != nil {
-		return err
+	if result, ok := result.(*[]Output); ok {
+		return unmarshalOutput(c, body, result)
+	}
+	if err := c.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("%w: %v", ErrProtocol, err)
 	}
 	return nil
 }
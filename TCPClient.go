@@ -2,13 +2,16 @@ package rpc
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/namitos/rpc/codec"
 	"github.com/namitos/rpc/packets"
 )
 
@@ -21,100 +24,638 @@ func NewTCPClient(URL string) Client {
 }
 
 type TCPClient struct {
-	URL               string
+	URL string
+	// ReconnectInterval is the delay between reconnect attempts, 1s when 0, unless Reconnect sets a backoff policy
 	ReconnectInterval time.Duration
+	Reconnect         *ReconnectPolicy
+	// OnStateChange is called with every ConnState the connection goes through, in order, from a goroutine of the client.
+	// err is why the connection was lost or could not be made
+	OnStateChange func(state ConnState, err error)
+	// ReconnectQueueSize lets that many calls wait for a connection while the client is connecting or reconnecting,
+	// each until its context is done, instead of failing with ErrNotConnected right away. They are sent once connected
+	ReconnectQueueSize int
+	// Logger receives connection state changes; nothing is logged when nil
+	Logger *slog.Logger
+	// Metrics counts traffic and reconnects when set
+	Metrics *Metrics
+	// HealthCheck makes Connect call health.check and use the connection only after the server reports ready
+	HealthCheck        bool
+	HealthCheckTimeout time.Duration
+	// MaxFrameSize limits responses, DefaultMaxMessageSize when 0; an oversized response closes the connection
+	MaxFrameSize uint64
+	// MaxMessageSize limits a response reassembled from chunks, MaxFrameSize when 0; the call waiting for a larger one fails
+	MaxMessageSize uint64
+	// ChunkSize splits requests into chunks of that many bytes, DefaultChunkSize when 0, when the handshake negotiated streaming
+	ChunkSize int
+	// ReadTimeout limits reading a response frame once it started arriving, WriteTimeout limits writing a request.
+	// IdleTimeout closes the connection after that long without calls, whatever heartbeats arrive; KeepAlive reconnects
+	// on the next call, which waits for the connection. 0 disables a timeout
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// WriteQueueSize is the number of request frames queued for writing, DefaultWriteQueueSize when 0.
+	// Calls wait for space in a full queue; the connection is closed when none frees up within WriteTimeout,
+	// DefaultQueueFullTimeout when 0
+	WriteQueueSize int
+	// Handshake opens connections with the versioned handshake; servers older than it only accept legacy connections
+	Handshake bool
+	// DisableCompression does not offer compression in the handshake. Requests from CompressionThreshold bytes,
+	// DefaultCompressionThreshold when 0, are gzip compressed when the server accepts it
+	DisableCompression   bool
+	CompressionThreshold int
+	// Codec is offered first in the handshake; the server falls back to JSON when it does not support it.
+	// Legacy connections always use JSON
+	Codec codec.Codec
+	// HeartbeatInterval pings the server that often when the handshake negotiated heartbeats. A connection with nothing
+	// from the server for HeartbeatMisses intervals, DefaultHeartbeatMisses when 0, is closed with ErrHeartbeatTimeout
+	// and KeepAlive reconnects. 0 sends no pings; pings of the server are answered either way.
+	// Heartbeats do not keep an unused connection open past the IdleTimeout of either side
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
 
-	waitingResponses   map[uint64]chan []byte
+	waitingResponses   map[uint64]chan tcpResponse
 	waitingResponsesMu sync.Mutex
-	connection         net.Conn
+	conn               atomic.Pointer[tcpConn]
 	counter            uint64
+
+	stateMu    sync.Mutex
+	closed     bool
+	done       chan struct{} //closed by Close
+	connected  chan struct{} //closed when conn is set, replaced when it is cleared
+	connection io.Closer     //the current connection, also while it is connecting
+	lastErr    error
+	running    sync.WaitGroup
+	lazy       bool          //the connection was closed by IdleTimeout; calls wait for the reconnect they trigger
+	wake       chan struct{} //made by an idle close and closed by the first call after it, which may come before KeepAlive reads it
+
+	state        ConnState
+	readyCount   int
+	queued       int
+	stateChanges []stateChange
+	dispatching  bool
+}
+
+// TCPClientOption configures a TCPClient created by Dial before it connects
+type TCPClientOption func(*TCPClient)
+
+// Dial creates a TCPClient configured by opts, which KeepAlive keeps connected to URL until Close,
+// and returns it once connected. When ctx is done first, the client is closed and the error of the last attempt returned
+func Dial(ctx context.Context, URL string, opts ...TCPClientOption) (*TCPClient, error) {
+	client := &TCPClient{URL: URL}
+	for _, opt := range opts {
+		opt(client)
+	}
+	go client.KeepAlive()
+	if err := client.WaitReady(ctx); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (h *TCPClient) logger() *slog.Logger {
+	return loggerOrDiscard(h.Logger)
 }
 
-// KeepAlive recursive reconnects if disconnected
+// KeepAlive connects and reconnects whenever the connection is lost, until Close or until Reconnect gives up
 func (h *TCPClient) KeepAlive() {
-	log.Println("connecting to", h.URL)
-	err := h.Connect()
-	h.connection = nil
-	if err != nil {
-		log.Println("tcp connection disconnected", err)
-		h.waitingResponsesMu.Lock()
-		for msgID, channel := range h.waitingResponses {
-			delete(h.waitingResponses, msgID)
-			if channel != nil {
-				channel <- []byte{} //TODO: send real error; now cannot parse empty json
-				close(channel)
+	h.stateMu.Lock()
+	if h.closed {
+		h.stateMu.Unlock()
+		return
+	}
+	h.running.Add(1)
+	done := h.doneChan()
+	h.stateMu.Unlock()
+	defer h.running.Done()
+	failures := 0
+	for {
+		h.logger().Info("TCPClient connecting", LogKeyURL, h.URL)
+		err := h.Connect()
+		if err == nil || errors.Is(err, ErrClientClosed) {
+			return
+		}
+		if errors.Is(err, ErrIdleTimeout) {
+			h.logger().Info("TCPClient idle until the next call", LogKeyURL, h.URL)
+			h.stateMu.Lock()
+			failures = 0
+			h.readyCount = 0
+			wake := h.wake
+			h.stateMu.Unlock()
+			select {
+			case <-done:
+				return
+			case <-wake:
+				continue
 			}
 		}
-		h.waitingResponsesMu.Unlock()
-		if h.ReconnectInterval == 0 {
-			h.ReconnectInterval = time.Second
+		h.stateMu.Lock()
+		h.lastErr = err
+		if h.readyCount > 0 { //the connection was lost, the attempt did not fail
+			failures = 0
+			h.readyCount = 0
+		} else {
+			failures++
+		}
+		h.stateMu.Unlock()
+		h.logger().Warn("TCPClient disconnected", LogKeyURL, h.URL, "err", err)
+		if h.Reconnect != nil && h.Reconnect.MaxAttempts > 0 && failures >= h.Reconnect.MaxAttempts {
+			h.logger().Error("TCPClient gave up reconnecting", LogKeyURL, h.URL, "attempts", failures, "err", err)
+			if h.shutdown() {
+				h.failWaitingResponses(ErrClientClosed)
+			}
+			return
 		}
-		time.AfterFunc(h.ReconnectInterval, func() {
-			h.KeepAlive()
-		})
+		timer := time.NewTimer(h.reconnectDelay(max(failures, 1)))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		h.Metrics.add(metricClientReconnects, 1, h.URL)
+	}
+}
+
+func (h *TCPClient) reconnectDelay(failures int) time.Duration {
+	if h.Reconnect != nil {
+		return h.Reconnect.delay(failures)
+	}
+	if h.ReconnectInterval == 0 {
+		return time.Second
+	}
+	return h.ReconnectInterval
+}
+
+// shutdown marks the client closed and reports whether it was open
+func (h *TCPClient) shutdown() bool {
+	h.stateMu.Lock()
+	if h.closed {
+		h.stateMu.Unlock()
+		return false
+	}
+	h.closed = true
+	close(h.doneChan())
+	h.stateMu.Unlock()
+	h.setState(StateClosed, nil)
+	return true
+}
+
+// Close stops KeepAlive and closes the connection; waiting and later calls fail with ErrClientClosed
+func (h *TCPClient) Close() error {
+	if !h.shutdown() {
+		return nil
+	}
+	h.stateMu.Lock()
+	connection := h.connection
+	h.stateMu.Unlock()
+	var err error
+	if connection != nil {
+		err = connection.Close()
 	}
+	h.running.Wait()
+	h.failWaitingResponses(ErrClientClosed)
+	return err
 }
 
-func (h *TCPClient) Connect() error {
-	connection, err := net.Dial("tcp", h.URL)
+// doneChan is closed by Close; stateMu is held
+func (h *TCPClient) doneChan() chan struct{} {
+	if h.done == nil {
+		h.done = make(chan struct{})
+	}
+	return h.done
+}
+
+// connectedChan is closed once connected; stateMu is held
+func (h *TCPClient) connectedChan() chan struct{} {
+	if h.connected == nil {
+		h.connected = make(chan struct{})
+	}
+	return h.connected
+}
+
+// setConn makes conn used by calls, or none when nil, and wakes up WaitReady
+func (h *TCPClient) setConn(conn *tcpConn) {
+	if conn != nil {
+		defer h.setState(StateReady, nil)
+	}
+	h.stateMu.Lock()
+	defer h.stateMu.Unlock()
+	h.conn.Store(conn)
+	if conn != nil {
+		h.readyCount++
+		h.lazy = false
+		close(h.connectedChan())
+	} else if h.connected != nil {
+		select {
+		case <-h.connected:
+			h.connected = nil
+		default:
+		}
+	}
+}
+
+// WaitReady waits until the client has a connection calls are sent on. It fails with ErrClientClosed when the client is closed
+// or gives up reconnecting, or with the error of ctx, both wrapping the error of the last attempt
+func (h *TCPClient) WaitReady(ctx context.Context) error {
+	h.stateMu.Lock()
+	connected := h.connectedChan()
+	done := h.doneChan()
+	h.stateMu.Unlock()
+	var err error
+	select {
+	case <-connected:
+		return nil
+	case <-done:
+		err = ErrClientClosed
+	case <-ctx.Done():
+		err = contextError(ctx)
+	}
+	h.stateMu.Lock()
+	lastErr := h.lastErr
+	h.stateMu.Unlock()
+	if lastErr != nil {
+		return fmt.Errorf("%w: %w", err, lastErr)
+	}
+	return err
+}
+
+// Connect connects and serves the connection until it is lost, which it returns the error of
+func (h *TCPClient) Connect() (err error) {
+	h.setState(StateConnecting, nil)
+	netConn, err := h.dial()
 	if err != nil {
+		if h.isClosed() {
+			return ErrClientClosed
+		}
+		h.setState(StateDisconnected, err)
 		return err
 	}
-	h.connection = connection
+	h.stateMu.Lock()
+	if h.closed {
+		h.stateMu.Unlock()
+		netConn.Close()
+		return ErrClientClosed
+	}
+	h.connection = netConn
+	h.stateMu.Unlock()
+	defer func() {
+		idle := errors.Is(err, ErrIdleTimeout)
+		h.stateMu.Lock()
+		h.connection = nil
+		closed := h.closed
+		if idle && !closed {
+			h.lazy = true
+			h.wake = make(chan struct{})
+		}
+		h.stateMu.Unlock()
+		h.setConn(nil)
+		switch {
+		case closed:
+			h.failWaitingResponses(ErrClientClosed)
+		case idle:
+			h.setState(StateIdle, err)
+			h.failWaitingResponses(fmt.Errorf("%w: %v", ErrDisconnected, err)) //sent while the connection was closing
+		default:
+			h.setState(StateDisconnected, err)
+			h.failWaitingResponses(fmt.Errorf("%w: %v", ErrDisconnected, err))
+		}
+	}()
+	connection := newDeadlineConn(netConn, h.ReadTimeout, h.WriteTimeout, h.IdleTimeout, h.hasWaitingResponses)
+	sess := &session{}
+	if h.Handshake {
+		if sess, err = h.handshake(connection); err != nil {
+			connection.Close()
+			return err
+		}
+	}
+	conn := &tcpConn{
+		writer:  newFrameWriter(connection, h.WriteQueueSize, h.WriteTimeout),
+		session: sess,
+	}
+	defer conn.writer.close()
+	hb := startHeartbeat(sess, conn.writer, h.HeartbeatInterval, h.HeartbeatMisses, func() { connection.Close() })
+	defer hb.close()
+	h.waitingResponsesMu.Lock()
 	if h.waitingResponses == nil {
-		h.waitingResponses = map[uint64]chan []byte{}
+		h.waitingResponses = map[uint64]chan tcpResponse{}
+	}
+	h.waitingResponsesMu.Unlock()
+	if !h.HealthCheck {
+		h.setConn(conn)
+		h.logger().Info("TCPClient connected", LogKeyURL, h.URL, LogKeyRemoteAddr, netConn.RemoteAddr().String())
+		return h.readResponses(connection, conn.writer, hb)
+	}
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- h.readResponses(connection, conn.writer, hb)
+	}()
+	if err = h.probeHealth(conn); err != nil {
+		connection.Close()
+		<-readErr
+		return err
 	}
+	h.setConn(conn)
+	h.logger().Info("TCPClient connected", LogKeyURL, h.URL, LogKeyRemoteAddr, netConn.RemoteAddr().String())
+	return <-readErr
+}
+
+// dial connects to URL until the client is closed, which also ends a Dial whose context is done
+func (h *TCPClient) dial() (net.Conn, error) {
+	h.stateMu.Lock()
+	done := h.doneChan()
+	h.stateMu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, "tcp", h.URL)
+}
+
+func (h *TCPClient) isClosed() bool {
+	h.stateMu.Lock()
+	defer h.stateMu.Unlock()
+	return h.closed
+}
+
+func (h *TCPClient) maxFrameSize() uint64 {
+	if h.MaxFrameSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return h.MaxFrameSize
+}
+
+func (h *TCPClient) maxMessageSize() uint64 {
+	if h.MaxMessageSize == 0 {
+		return h.maxFrameSize()
+	}
+	return h.MaxMessageSize
+}
+
+func (h *TCPClient) handshake(connection *deadlineConn) (*session, error) {
+	frame, err := packets.CreateHello(packets.Version, localHello(h.maxFrameSize(), !h.DisableCompression, h.Codec))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := connection.Write(frame); err != nil {
+		return nil, err
+	}
+	version, serverHello, err := packets.ReadHello(connection, h.maxFrameSize())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	return acceptSession(version, serverHello)
+}
+
+func (h *TCPClient) hasWaitingResponses() bool {
+	h.waitingResponsesMu.Lock()
+	defer h.waitingResponsesMu.Unlock()
+	return len(h.waitingResponses) > 0
+}
+
+func (h *TCPClient) readResponses(connection *deadlineConn, writer *frameWriter, hb *heartbeat) error {
+	frames := packets.NewReader(connection)
+	chunks := newReassembler(h.maxMessageSize())
 	for {
-		response, _, msgID, _, err := packets.Parse(h.connection)
+		if frames.Buffered() == 0 {
+			connection.startFrame()
+		}
+		frame, messageType, msgID, length, err := frames.ReadFrame(h.maxFrameSize())
+		var response []byte
+		if err == nil {
+			h.Metrics.add(metricClientReceived, float64(length+packets.HeaderLength), TransportTCP)
+			hb.received()
+			if controlFrame(writer, messageType, msgID) {
+				packets.Release(frame)
+				continue
+			}
+			connection.active()
+			var complete bool
+			frame, messageType, complete, err = chunks.add(frame, messageType, msgID)
+			if errors.Is(err, packets.ErrTooLarge) {
+				h.deliverResponse(msgID, tcpResponse{err: fmt.Errorf("%w: response exceeds %v bytes", packets.ErrTooLarge, h.maxMessageSize())})
+				continue
+			}
+			if err == nil && !complete {
+				continue
+			}
+		}
+		if err == nil {
+			response, err = readFrameBody(frame, messageType, h.maxMessageSize())
+		}
 		if err != nil {
+			err = hb.err(err)
+			if errors.Is(err, ErrIdleTimeout) || errors.Is(err, ErrHeartbeatTimeout) {
+				h.logger().Info("TCPClient connection closed", LogKeyURL, h.URL, "reason", closeReason(err))
+			}
+			connection.Close()
 			return err
 		}
-		h.waitingResponsesMu.Lock()
-		channel := h.waitingResponses[msgID]
-		delete(h.waitingResponses, msgID)
-		h.waitingResponsesMu.Unlock()
-		if channel != nil {
-			channel <- response
-			close(channel)
+		h.deliverResponse(msgID, tcpResponse{body: response})
+	}
+}
+
+func (h *TCPClient) deliverResponse(msgID uint64, response tcpResponse) {
+	h.waitingResponsesMu.Lock()
+	channel := h.waitingResponses[msgID]
+	delete(h.waitingResponses, msgID)
+	h.waitingResponsesMu.Unlock()
+	if channel != nil {
+		channel <- response
+	} else {
+		packets.Release(response.body)
+	}
+}
+
+// tcpConn is an established connection of TCPClient
+type tcpConn struct {
+	writer  *frameWriter
+	session *session
+}
+
+// tcpResponse is delivered exactly once to a waiting call: its channel is buffered and removed from waitingResponses before sending
+type tcpResponse struct {
+	body []byte
+	err  error
+}
+
+// waitConn holds a call made without a connection until there is one, when ReconnectQueueSize has room for it
+// or the connection was closed by IdleTimeout, which the call then reconnects
+func (h *TCPClient) waitConn(ctx context.Context) (*tcpConn, error) {
+	h.stateMu.Lock()
+	if h.closed {
+		h.stateMu.Unlock()
+		return nil, ErrClientClosed
+	}
+	if h.lazy {
+		select {
+		case <-h.wake:
+		default:
+			close(h.wake)
+		}
+		h.stateMu.Unlock()
+		return h.readyConn(ctx)
+	}
+	if h.queued >= h.ReconnectQueueSize {
+		queued := h.queued
+		h.stateMu.Unlock()
+		if queued > 0 {
+			return nil, fmt.Errorf("%w: %v calls queued already", ErrNotConnected, queued)
+		}
+		return nil, ErrNotConnected
+	}
+	h.queued++
+	h.stateMu.Unlock()
+	defer func() {
+		h.stateMu.Lock()
+		h.queued--
+		h.stateMu.Unlock()
+	}()
+	return h.readyConn(ctx)
+}
+
+// readyConn waits for a connection calls are sent on
+func (h *TCPClient) readyConn(ctx context.Context) (*tcpConn, error) {
+	for {
+		if err := h.WaitReady(ctx); err != nil {
+			return nil, err
+		}
+		if conn := h.conn.Load(); conn != nil {
+			return conn, nil
 		}
 	}
 }
 
+func (h *TCPClient) failWaitingResponses(err error) {
+	h.waitingResponsesMu.Lock()
+	defer h.waitingResponsesMu.Unlock()
+	for msgID, channel := range h.waitingResponses {
+		delete(h.waitingResponses, msgID)
+		channel <- tcpResponse{err: err}
+	}
+}
+
+// probeHealth calls health.check on a connection which is not used by Call yet
+func (h *TCPClient) probeHealth(conn *tcpConn) error {
+	timeout := h.HealthCheckTimeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	report := &HealthReport{}
+	output := []Output{{Result: report}}
+	if err := h.call(ctx, conn, []Input{{Method: MethodHealthCheck}}, &output); err != nil {
+		return err
+	}
+	if output[0].Error != nil {
+		return output[0].Error
+	}
+	if !report.Ready {
+		return fmt.Errorf("server is not ready: %v", report.Status)
+	}
+	return nil
+}
+
 func (h *TCPClient) Call(ctx context.Context, input []Input, result *[]Output) error {
-	if h.connection == nil {
-		return fmt.Errorf("client not connected")
+	conn := h.conn.Load()
+	if conn == nil {
+		var err error
+		if conn, err = h.waitConn(ctx); err != nil {
+			return err
+		}
+	}
+	return h.call(ctx, conn, input, result)
+}
+
+func (h *TCPClient) call(ctx context.Context, conn *tcpConn, input []Input, result *[]Output) error {
+	if tc, ok := TraceFromContext(ctx); ok {
+		input = withTrace(input, tc)
 	}
-	body, err := json.Marshal(input)
+	c := conn.session.getCodec()
+	body, err := c.Marshal(input)
 	if err != nil {
 		return err
 	}
-	channel := make(chan []byte)
+	channel := make(chan tcpResponse, 1)
 	h.waitingResponsesMu.Lock()
 	h.counter++
 	msgID := h.counter
 	h.waitingResponses[msgID] = channel
 	h.waitingResponsesMu.Unlock()
-	h.connection.Write(packets.Create(body, 0, msgID))
-	var response []byte
+	frames := createFrames(conn.session, body, packets.TypeMessage, msgID, h.CompressionThreshold, h.ChunkSize)
+	n, err := writeFrames(conn.writer, frames)
+	h.Metrics.add(metricClientSent, float64(n), TransportTCP)
+	if err != nil {
+		h.waitingResponsesMu.Lock()
+		delete(h.waitingResponses, msgID)
+		h.waitingResponsesMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
 	select {
-	case response = <-channel:
-		{
-			if err = json.Unmarshal(response, result); err != nil {
-				return err
-			}
-			return nil
+	case response := <-channel:
+		if response.err != nil {
+			return response.err
 		}
+		defer packets.Release(response.body)
+		return unmarshalOutput(c, response.body, result)
 	case <-ctx.Done():
-		{
-			h.waitingResponsesMu.Lock()
-			delete(h.waitingResponses, msgID)
-			close(channel)
-			h.waitingResponsesMu.Unlock()
-			return ctx.Err()
+		h.waitingResponsesMu.Lock()
+		delete(h.waitingResponses, msgID)
+		h.waitingResponsesMu.Unlock()
+		return contextError(ctx)
+	}
+}
+
+// Notify calls method without waiting; the response the server sends anyway is dropped
+func (h *TCPClient) Notify(ctx context.Context, method string, params any) error {
+	conn := h.conn.Load()
+	if conn == nil {
+		var err error
+		if conn, err = h.waitConn(ctx); err != nil {
+			return err
 		}
 	}
+	input := []Input{{Method: method, Params: params}}
+	if tc, ok := TraceFromContext(ctx); ok {
+		input = withTrace(input, tc)
+	}
+	body, err := conn.session.getCodec().Marshal(input)
+	if err != nil {
+		return err
+	}
+	h.waitingResponsesMu.Lock()
+	h.counter++
+	msgID := h.counter
+	h.waitingResponsesMu.Unlock()
+	frames := createFrames(conn.session, body, packets.TypeMessage, msgID, h.CompressionThreshold, h.ChunkSize)
+	n, err := writeFrames(conn.writer, frames)
+	h.Metrics.add(metricClientSent, float64(n), TransportTCP)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	return nil
 }
 
 func (h *TCPClient) CallSingle(ctx context.Context, method string, params any, result any) error {
 	return CallSingle(h, ctx, method, params, result)
 }
+
+// withTrace returns a copy of input with the trace context set on items which have none
+func withTrace(input []Input, tc TraceContext) []Input {
+	traced := make([]Input, len(input))
+	for i, item := range input {
+		if item.Traceparent == "" {
+			item.Traceparent = tc.Traceparent()
+			item.Tracestate = tc.State
+		}
+		traced[i] = item
+	}
+	return traced
+}
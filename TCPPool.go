@@ -0,0 +1,101 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPoolSize is the number of connections of a TCPPool unless configured otherwise
+const DefaultPoolSize = 4
+
+func NewTCPPool(URL string, size int) *TCPPool {
+	pool := &TCPPool{
+		URL:  URL,
+		Size: size,
+	}
+	pool.Start()
+	return pool
+}
+
+// TCPPool keeps Size connections to URL, each one a TCPClient, and sends every call on the connected one
+// with the fewest calls in flight, so a large response only holds back calls on its own connection.
+// Broken connections are replaced by their clients reconnecting
+type TCPPool struct {
+	URL  string
+	Size int
+	// Configure sets options of every TCPClient of the pool before it connects
+	Configure func(*TCPClient)
+
+	clients   []*pooledClient
+	startOnce sync.Once
+}
+
+type pooledClient struct {
+	client   *TCPClient
+	inFlight atomic.Int64
+}
+
+// Start connects the pool in the background; Call starts it as well
+func (p *TCPPool) Start() {
+	p.startOnce.Do(func() {
+		size := p.Size
+		if size <= 0 {
+			size = DefaultPoolSize
+		}
+		p.clients = make([]*pooledClient, size)
+		for i := range p.clients {
+			client := &TCPClient{URL: p.URL}
+			if p.Configure != nil {
+				p.Configure(client)
+			}
+			p.clients[i] = &pooledClient{client: client}
+			go client.KeepAlive()
+		}
+	})
+}
+
+// pick returns the connected client with the fewest calls in flight. When none is connected it is picked among all,
+// which queue the call with ReconnectQueueSize or fail it with ErrNotConnected
+func (p *TCPPool) pick() *pooledClient {
+	var best, bestConnected *pooledClient
+	for _, c := range p.clients {
+		if best == nil || c.inFlight.Load() < best.inFlight.Load() {
+			best = c
+		}
+		if c.client.conn.Load() == nil {
+			continue
+		}
+		if bestConnected == nil || c.inFlight.Load() < bestConnected.inFlight.Load() {
+			bestConnected = c
+		}
+	}
+	if bestConnected != nil {
+		return bestConnected
+	}
+	return best
+}
+
+func (p *TCPPool) Call(ctx context.Context, input []Input, result *[]Output) error {
+	p.Start()
+	c := p.pick()
+	c.inFlight.Add(1)
+	defer c.inFlight.Add(-1)
+	return c.client.Call(ctx, input, result)
+}
+
+// Close closes every connection of the pool, which cannot be used afterwards
+func (p *TCPPool) Close() error {
+	p.Start()
+	var err error
+	for _, c := range p.clients {
+		if closeErr := c.client.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (p *TCPPool) CallSingle(ctx context.Context, method string, params any, result any) error {
+	return CallSingle(p, ctx, method, params, result)
+}
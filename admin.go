@@ -0,0 +1,167 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/namitos/rpc/codec"
+)
+
+// Admin methods answered when Server.AdminMethods is set
+const (
+	MethodAdminInflight = "admin.inflight"
+	MethodAdminCancel   = "admin.cancel"
+)
+
+// ParamsPreviewLength limits the params shown for an in-flight call
+const ParamsPreviewLength = 256
+
+// ErrCanceledByAdmin is the context cause of calls canceled with admin.cancel
+var ErrCanceledByAdmin = errors.New("call canceled by admin")
+
+type InflightCall struct {
+	ID         uint64    `json:"id"`
+	Method     string    `json:"method"`
+	MessageID  uint64    `json:"messageID"`
+	ConnID     uint64    `json:"connID,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	Transport  string    `json:"transport,omitempty"`
+	Start      time.Time `json:"start"`
+	Elapsed    string    `json:"elapsed"`
+	Params     string    `json:"params,omitempty"`
+}
+
+type inflightCall struct {
+	InflightCall
+	cancel context.CancelCauseFunc
+	codec  codec.Codec
+	params codec.RawMessage //converted to the Params preview only when listed
+}
+
+type inflightState struct {
+	calls sync.Map
+	ids   atomic.Uint64
+}
+
+func (h *Server) startInflight(ctx context.Context, c codec.Codec, messageID uint64, inputItem *inputPartial) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	call := &inflightCall{
+		InflightCall: InflightCall{
+			ID:        h.inflight.ids.Add(1),
+			Method:    inputItem.Method,
+			MessageID: messageID,
+			Start:     time.Now(),
+		},
+		cancel: cancel,
+		codec:  c,
+		params: inputItem.Params,
+	}
+	if p := peerFromContext(ctx); p != nil {
+		call.ConnID = p.connID
+		call.RemoteAddr = p.remoteAddr
+		call.Transport = p.transport
+	}
+	h.inflight.calls.Store(call.ID, call)
+	return ctx, func() {
+		h.inflight.calls.Delete(call.ID)
+		cancel(nil)
+	}
+}
+
+// Inflight lists running calls, the longest running first
+func (h *Server) Inflight() []InflightCall {
+	calls := []InflightCall{}
+	now := time.Now()
+	h.inflight.calls.Range(func(k, v any) bool {
+		call := v.(*inflightCall).InflightCall
+		call.Elapsed = now.Sub(call.Start).String()
+		call.Params = paramsPreview(v.(*inflightCall).codec, v.(*inflightCall).params)
+		calls = append(calls, call)
+		return true
+	})
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].Start.Before(calls[j].Start)
+	})
+	return calls
+}
+
+// paramsPreview shows params as JSON whatever codec they came in
+func paramsPreview(c codec.Codec, params codec.RawMessage) string {
+	if c != nil && c != codec.JSON && params != nil {
+		var v any
+		if c.Unmarshal(params, &v) == nil {
+			params, _ = json.Marshal(v)
+		}
+	}
+	preview := string(params)
+	if len(preview) > ParamsPreviewLength {
+		cut := ParamsPreviewLength
+		for cut > 0 && !utf8.RuneStart(preview[cut]) {
+			cut--
+		}
+		preview = preview[:cut] + "…"
+	}
+	return preview
+}
+
+// CancelInflight cancels the context of a running call; only handlers accepting context.Context can observe it
+func (h *Server) CancelInflight(id uint64) bool {
+	call, ok := h.inflight.calls.Load(id)
+	if !ok {
+		return false
+	}
+	call.(*inflightCall).cancel(ErrCanceledByAdmin)
+	return true
+}
+
+type adminCancelParams struct {
+	ID uint64 `json:"id" validate:"required"`
+}
+
+func adminEnabled(h *Server) bool {
+	return h.AdminMethods
+}
+
+func (h *Server) setAdminBuiltins() {
+	h.setBuiltin(MethodAdminInflight, func() []InflightCall {
+		return h.Inflight()
+	}, adminEnabled)
+	h.setBuiltin(MethodAdminCancel, func(params adminCancelParams) (bool, error) {
+		if !h.CancelInflight(params.ID) {
+			return false, &OutputError{Code: ErrorCodeInvalidParams, Message: "call not found"}
+		}
+		return true, nil
+	}, adminEnabled)
+}
+
+// HandleAdmin lists in-flight calls on GET and cancels the call given by the "cancel" query parameter on POST.
+// It does not check who is asking and ListenHTTP does not mount it: mount it on a private listener or behind auth
+func (h *Server) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		SendAPIResult(w, h.Inflight(), nil)
+	case "POST":
+		id, err := strconv.ParseUint(r.URL.Query().Get("cancel"), 10, 64)
+		if err != nil {
+			SendAPIError(w, err)
+			return
+		}
+		if !h.CancelInflight(id) {
+			setDefaultHeaders(w)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"message":"call not found"}}`))
+			return
+		}
+		SendAPIResult(w, true, nil)
+	default:
+		SendAPIError(w, errors.New("not implemented"))
+	}
+}
@@ -0,0 +1,112 @@
+package rpc
+
+import (
+	"fmt"
+
+	"github.com/namitos/rpc/packets"
+)
+
+// DefaultChunkSize is the largest frame body sent on connections which negotiated streaming unless configured otherwise
+const DefaultChunkSize = 1 << 20
+
+// createFrames encodes a message, split into chunks of chunkSize when the session negotiated streaming.
+// The payload is compressed before splitting, so every chunk carries the compression flag of the whole message
+func createFrames(sess *session, body []byte, messageType, messageID uint64, threshold, chunkSize int) []outFrame {
+	body, messageType = compressPayload(sess, body, messageType, threshold)
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if sess.peerMaxFrameSize > 0 && uint64(chunkSize) > sess.peerMaxFrameSize {
+		chunkSize = int(sess.peerMaxFrameSize)
+	}
+	if !sess.streaming || len(body) <= chunkSize {
+		return []outFrame{{body, messageType, messageID}}
+	}
+	frames := make([]outFrame, 0, (len(body)+chunkSize-1)/chunkSize)
+	for seq := uint64(0); len(body) > 0; seq++ {
+		n := min(chunkSize, len(body))
+		chunkType := messageType | seq<<packets.ChunkSeqShift
+		if n < len(body) {
+			chunkType |= packets.FlagMore
+		}
+		frames = append(frames, outFrame{body[:n], chunkType, messageID})
+		body = body[n:]
+	}
+	return frames
+}
+
+// writeFrames queues the frames of a message in order; other messages may be written between them
+func writeFrames(writer *frameWriter, frames []outFrame) (int, error) {
+	n := 0
+	for _, frame := range frames {
+		if err := writer.write(frame); err != nil {
+			return n, err
+		}
+		n += frame.length()
+	}
+	return n, nil
+}
+
+// reassembler collects chunks of the messages arriving on one connection; it owns the frames passed to add
+// and releases those it copies. maxLength limits a single message
+// and all incomplete messages together, so a peer cannot make a connection hold more than that
+type reassembler struct {
+	maxLength uint64
+	pending   map[uint64]*partialMessage
+	size      uint64
+}
+
+type partialMessage struct {
+	body        []byte
+	messageType uint64
+	next        uint64
+	rejected    bool
+}
+
+func newReassembler(maxLength uint64) *reassembler {
+	return &reassembler{maxLength: maxLength, pending: map[uint64]*partialMessage{}}
+}
+
+// add returns the message completed by a frame along with its type without chunk bits; complete is false
+// while more chunks are expected. A message passing maxLength fails with packets.ErrTooLarge once, its remaining chunks are dropped.
+// Chunks out of sequence fail with ErrProtocol
+func (a *reassembler) add(frame []byte, messageType, messageID uint64) (message []byte, wholeType uint64, complete bool, err error) {
+	seq := messageType >> packets.ChunkSeqShift
+	more := messageType&packets.FlagMore != 0
+	wholeType = messageType & (1<<packets.ChunkSeqShift - 1) &^ packets.FlagMore
+	p := a.pending[messageID]
+	if p == nil {
+		if seq != 0 {
+			return nil, wholeType, false, fmt.Errorf("%w: chunk %v of message %v without its start", ErrProtocol, seq, messageID)
+		}
+		if !more {
+			return frame, wholeType, true, nil
+		}
+		p = &partialMessage{messageType: wholeType}
+		a.pending[messageID] = p
+	} else if seq != p.next {
+		return nil, wholeType, false, fmt.Errorf("%w: chunk %v of message %v, expected %v", ErrProtocol, seq, messageID, p.next)
+	}
+	p.next++
+	if !more {
+		delete(a.pending, messageID)
+	}
+	if p.rejected {
+		return nil, wholeType, false, nil
+	}
+	length := uint64(len(frame))
+	if uint64(len(p.body))+length > a.maxLength || a.size+length > a.maxLength {
+		p.rejected = true
+		a.size -= uint64(len(p.body))
+		p.body = nil
+		return nil, wholeType, false, packets.ErrTooLarge
+	}
+	p.body = append(p.body, frame...)
+	packets.Release(frame)
+	a.size += length
+	if more {
+		return nil, wholeType, false, nil
+	}
+	a.size -= uint64(len(p.body))
+	return p.body, p.messageType, true, nil
+}
@@ -0,0 +1,207 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// cborCodec implements CBOR (RFC 8949). Tags are skipped when decoding; indefinite lengths are not supported
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return NameCBOR
+}
+
+func (cborCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func (cborCodec) Marshal(v any) ([]byte, error) {
+	w := &cborWriter{}
+	if err := encode(w, v); err != nil {
+		return nil, err
+	}
+	return w.b, nil
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	return decode(&cborReader{byteReader{b: data}}, v)
+}
+
+func (cborCodec) IsArray(data []byte) bool {
+	return len(data) > 0 && data[0]>>5 == cborArray
+}
+
+// CBOR major types
+const (
+	cborUint byte = iota
+	cborNegInt
+	cborBytes
+	cborString
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+type cborWriter struct {
+	b []byte
+}
+
+func (w *cborWriter) head(major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		w.b = append(w.b, major|byte(n))
+	case n <= math.MaxUint8:
+		w.b = append(w.b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, major|26), uint32(n))
+	default:
+		w.b = binary.BigEndian.AppendUint64(append(w.b, major|27), n)
+	}
+}
+
+func (w *cborWriter) writeNil() {
+	w.b = append(w.b, 0xf6)
+}
+
+func (w *cborWriter) writeBool(b bool) {
+	if b {
+		w.b = append(w.b, 0xf5)
+	} else {
+		w.b = append(w.b, 0xf4)
+	}
+}
+
+func (w *cborWriter) writeInt(i int64) {
+	if i < 0 {
+		w.head(cborNegInt, uint64(^i))
+	} else {
+		w.head(cborUint, uint64(i))
+	}
+}
+
+func (w *cborWriter) writeUint(u uint64) {
+	w.head(cborUint, u)
+}
+
+func (w *cborWriter) writeFloat32(f float32) {
+	w.b = binary.BigEndian.AppendUint32(append(w.b, 0xfa), math.Float32bits(f))
+}
+
+func (w *cborWriter) writeFloat64(f float64) {
+	w.b = binary.BigEndian.AppendUint64(append(w.b, 0xfb), math.Float64bits(f))
+}
+
+func (w *cborWriter) writeString(s string) {
+	w.head(cborString, uint64(len(s)))
+	w.b = append(w.b, s...)
+}
+
+func (w *cborWriter) writeBytes(b []byte) {
+	w.head(cborBytes, uint64(len(b)))
+	w.b = append(w.b, b...)
+}
+
+func (w *cborWriter) writeArrayHeader(n int) {
+	w.head(cborArray, uint64(n))
+}
+
+func (w *cborWriter) writeMapHeader(n int) {
+	w.head(cborMap, uint64(n))
+}
+
+func (w *cborWriter) writeRaw(b []byte) {
+	w.b = append(w.b, b...)
+}
+
+type cborReader struct {
+	byteReader
+}
+
+func (r *cborReader) readItem() (item, error) {
+	for {
+		b, err := r.next(1)
+		if err != nil {
+			return item{}, err
+		}
+		major, info := b[0]>>5, b[0]&0x1f
+		if major == cborSimple {
+			return r.simple(info)
+		}
+		var arg uint64
+		switch {
+		case info < 24:
+			arg = uint64(info)
+		case info <= 27:
+			if arg, err = r.uint(1 << (info - 24)); err != nil {
+				return item{}, err
+			}
+		case info == 31:
+			return item{}, fmt.Errorf("codec: indefinite length cbor items are not supported")
+		default:
+			return item{}, fmt.Errorf("codec: malformed cbor item 0x%02x", b[0])
+		}
+		switch major {
+		case cborUint:
+			return item{kind: kindUint, u: arg}, nil
+		case cborNegInt:
+			if arg > math.MaxInt64 {
+				return item{}, fmt.Errorf("codec: cbor integer overflows int64")
+			}
+			return item{kind: kindInt, i: -1 - int64(arg)}, nil
+		case cborBytes:
+			return r.bytes(kindBytes, arg)
+		case cborString:
+			return r.bytes(kindString, arg)
+		case cborArray:
+			return r.container(kindArray, arg)
+		case cborMap:
+			return r.container(kindMap, arg)
+		}
+		//cborTag: the tagged item is decoded as it is
+	}
+}
+
+func (r *cborReader) simple(info byte) (item, error) {
+	switch info {
+	case 20, 21:
+		return item{kind: kindBool, b: info == 21}, nil
+	case 22, 23:
+		return item{kind: kindNil}, nil
+	case 25:
+		u, err := r.uint(2)
+		return item{kind: kindFloat, f: halfToFloat(uint16(u))}, err
+	case 26:
+		u, err := r.uint(4)
+		return item{kind: kindFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 27:
+		u, err := r.uint(8)
+		return item{kind: kindFloat, f: math.Float64frombits(u)}, err
+	}
+	return item{}, fmt.Errorf("codec: unsupported cbor simple value %v", info)
+}
+
+func halfToFloat(h uint16) float64 {
+	exp, mant := int(h>>10&0x1f), float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		f = math.Inf(1)
+		if mant != 0 {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
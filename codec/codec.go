@@ -0,0 +1,103 @@
+// Package codec encodes RPC messages; JSON is the default, MessagePack and CBOR are binary alternatives
+package codec
+
+import (
+	"mime"
+	"strings"
+	"sync"
+)
+
+// Names of the in-tree codecs, used in the TCP handshake
+const (
+	NameJSON        = "json"
+	NameMessagePack = "msgpack"
+	NameCBOR        = "cbor"
+)
+
+// Codec encodes messages. The binary codecs follow the json struct tags and use
+// encoding.TextMarshaler and json.Marshaler where a type has them, so types written for encoding/json need no changes
+type Codec interface {
+	Name() string
+	ContentType() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+	// IsArray reports whether data encodes an array, which is how a batch of calls is sent
+	IsArray(data []byte) bool
+}
+
+var (
+	JSON        Codec = jsonCodec{}
+	MessagePack Codec = msgpackCodec{}
+	CBOR        Codec = cborCodec{}
+)
+
+var (
+	registry   = map[string]Codec{}
+	registered []string
+	registryMu sync.RWMutex
+)
+
+func init() {
+	Register(JSON)
+	Register(MessagePack)
+	Register(CBOR)
+}
+
+// Register makes c available by name and content type; a codec of the same name is replaced
+func Register(c Codec) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[c.Name()]; !ok {
+		registered = append(registered, c.Name())
+	}
+	registry[c.Name()] = c
+}
+
+// ByName returns nil for an unknown codec
+func ByName(name string) Codec {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[name]
+}
+
+// ByContentType finds the codec of a Content-Type header, ignoring its parameters; nil when there is none
+func ByContentType(contentType string) Codec {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	if mediaType == "application/x-msgpack" {
+		mediaType = MessagePack.ContentType()
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, name := range registered {
+		if c := registry[name]; strings.EqualFold(c.ContentType(), mediaType) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Names lists registered codecs in registration order
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]string(nil), registered...)
+}
+
+// RawMessage is an encoded value kept as it is, like json.RawMessage but for any codec.
+// It is only valid for the codec which produced it
+type RawMessage []byte
+
+func (m RawMessage) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+	return m, nil
+}
+
+func (m *RawMessage) UnmarshalJSON(data []byte) error {
+	*m = append((*m)[0:0], data...)
+	return nil
+}
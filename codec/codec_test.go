@@ -0,0 +1,193 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testEmbedded struct {
+	Embedded string `json:"embedded"`
+}
+
+type testValue struct {
+	testEmbedded
+	Name     string            `json:"name"`
+	Skipped  string            `json:"-"`
+	Empty    string            `json:"empty,omitempty"`
+	Count    int64             `json:"count"`
+	Ratio    float32           `json:"ratio"`
+	Negative int8              `json:"negative"`
+	Big      uint64            `json:"big"`
+	Data     []byte            `json:"data"`
+	Tags     []string          `json:"tags"`
+	ByID     map[int]string    `json:"byID"`
+	Ptr      *bool             `json:"ptr"`
+	NilPtr   *bool             `json:"nilPtr"`
+	Time     time.Time         `json:"time"`
+	JSON     json.RawMessage   `json:"json"`
+	Any      any               `json:"any"`
+	Nested   map[string][]bool `json:"nested"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	yes := true
+	in := testValue{
+		testEmbedded: testEmbedded{Embedded: "e"},
+		Name:         "name",
+		Skipped:      "skipped",
+		Count:        1 << 40,
+		Ratio:        0.5,
+		Negative:     -100,
+		Big:          1<<64 - 1,
+		Data:         []byte{0, 1, 2},
+		Tags:         []string{"a", "b"},
+		ByID:         map[int]string{1: "one", -2: "minus two"},
+		Ptr:          &yes,
+		Time:         time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC),
+		JSON:         json.RawMessage(`{"x":[1,2]}`),
+		Any:          map[string]any{"list": []any{"s", int64(-3), 1.5, nil}},
+		Nested:       map[string][]bool{"k": {true, false}},
+	}
+	for _, c := range []Codec{MessagePack, CBOR} {
+		b, err := c.Marshal(in)
+		if err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		out := testValue{}
+		if err := c.Unmarshal(b, &out); err != nil {
+			t.Fatal(c.Name(), err)
+		}
+		want := in
+		want.Skipped = ""
+		want.JSON = json.RawMessage(`{"x":[1,2]}`)
+		if !reflect.DeepEqual(out, want) {
+			t.Fatalf("%v:\n%+v\n%+v", c.Name(), out, want)
+		}
+		if c.IsArray(b) {
+			t.Fatal(c.Name(), "struct is reported as array")
+		}
+	}
+}
+
+func TestKnownEncodings(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		value any
+		want  []byte
+	}{
+		{MessagePack, map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{MessagePack, []any{-1, nil, true}, []byte{0x93, 0xff, 0xc0, 0xc3}},
+		{MessagePack, 300, []byte{0xcd, 0x01, 0x2c}},
+		{CBOR, []any{1, -1, "a"}, []byte{0x83, 0x01, 0x20, 0x61, 'a'}},
+		{CBOR, map[string]any{"a": nil}, []byte{0xa1, 0x61, 'a', 0xf6}},
+		{CBOR, 1000, []byte{0x19, 0x03, 0xe8}},
+	}
+	for _, test := range tests {
+		b, err := test.codec.Marshal(test.value)
+		if err != nil || !bytes.Equal(b, test.want) {
+			t.Fatalf("%v %v: % x %v", test.codec.Name(), test.value, b, err)
+		}
+	}
+	var f float64
+	if err := CBOR.Unmarshal([]byte{0xf9, 0x3e, 0x00}, &f); err != nil || f != 1.5 {
+		t.Fatal("half float", f, err)
+	}
+	var tagged string
+	if err := CBOR.Unmarshal([]byte{0xc0, 0x61, 'x'}, &tagged); err != nil || tagged != "x" {
+		t.Fatal("tagged", tagged, err)
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	type envelope struct {
+		Method string     `json:"method"`
+		Params RawMessage `json:"params"`
+	}
+	for _, c := range []Codec{JSON, MessagePack, CBOR} {
+		b, err := c.Marshal([]any{map[string]any{"method": "m", "params": []int{1, 2}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !c.IsArray(b) {
+			t.Fatal(c.Name(), "array is not reported")
+		}
+		var batch []envelope
+		if err := c.Unmarshal(b, &batch); err != nil || len(batch) != 1 || batch[0].Method != "m" {
+			t.Fatal(c.Name(), batch, err)
+		}
+		params := []int{}
+		if err := c.Unmarshal(batch[0].Params, &params); err != nil || !reflect.DeepEqual(params, []int{1, 2}) {
+			t.Fatal(c.Name(), params, err)
+		}
+		again, err := c.Marshal(batch[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Unmarshal(again, &batch[0]); err != nil || batch[0].Method != "m" {
+			t.Fatal(c.Name(), "RawMessage is not written as it is", err)
+		}
+	}
+}
+
+func TestDecodeIntoInterfacePointer(t *testing.T) {
+	type output struct {
+		Result any `json:"result"`
+	}
+	for _, c := range []Codec{MessagePack, CBOR} {
+		b, _ := c.Marshal(output{Result: []string{"a"}})
+		result := []string{}
+		out := output{Result: &result}
+		if err := c.Unmarshal(b, &out); err != nil || !reflect.DeepEqual(result, []string{"a"}) {
+			t.Fatal(c.Name(), result, err)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	inputs := [][]byte{
+		{},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{0xdb, 0x00, 0x00, 0x00, 0x10, 'a'},
+		{0x7b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 'a'},
+		bytes.Repeat([]byte{0x91}, 2000),
+		bytes.Repeat([]byte{0x81}, 2000),
+	}
+	for _, input := range inputs {
+		for _, c := range []Codec{MessagePack, CBOR} {
+			var v any
+			if err := c.Unmarshal(input, &v); err == nil {
+				t.Fatalf("%v % x: no error", c.Name(), input[:min(len(input), 8)])
+			}
+		}
+	}
+	var s string
+	if err := MessagePack.Unmarshal([]byte{0x01}, &s); err == nil {
+		t.Fatal("int decoded into string")
+	}
+	if err := CBOR.Unmarshal([]byte{0x01, 0x01}, &s); err == nil {
+		t.Fatal("trailing data accepted")
+	}
+}
+
+func TestByContentType(t *testing.T) {
+	tests := map[string]Codec{
+		"application/json; charset=utf-8": JSON,
+		"application/msgpack":             MessagePack,
+		"application/x-msgpack":           MessagePack,
+		"application/cbor":                CBOR,
+		"text/plain":                      nil,
+		"":                                nil,
+	}
+	for contentType, want := range tests {
+		if got := ByContentType(contentType); got != want {
+			t.Fatalf("%q: %v", contentType, got)
+		}
+	}
+	if ByName(NameCBOR) != CBOR || ByName("xml") != nil {
+		t.Fatal("ByName")
+	}
+}
@@ -0,0 +1,215 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// msgpackCodec implements MessagePack; extension types are not supported
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return NameMessagePack
+}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	w := &msgpackWriter{}
+	if err := encode(w, v); err != nil {
+		return nil, err
+	}
+	return w.b, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	return decode(&msgpackReader{byteReader{b: data}}, v)
+}
+
+func (msgpackCodec) IsArray(data []byte) bool {
+	return len(data) > 0 && (data[0]&0xf0 == 0x90 || data[0] == 0xdc || data[0] == 0xdd)
+}
+
+type msgpackWriter struct {
+	b []byte
+}
+
+func (w *msgpackWriter) writeNil() {
+	w.b = append(w.b, 0xc0)
+}
+
+func (w *msgpackWriter) writeBool(b bool) {
+	if b {
+		w.b = append(w.b, 0xc3)
+	} else {
+		w.b = append(w.b, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) writeInt(i int64) {
+	switch {
+	case i >= 0:
+		w.writeUint(uint64(i))
+	case i >= -32:
+		w.b = append(w.b, byte(i))
+	case i >= math.MinInt8:
+		w.b = append(w.b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, 0xd2), uint32(i))
+	default:
+		w.b = binary.BigEndian.AppendUint64(append(w.b, 0xd3), uint64(i))
+	}
+}
+
+func (w *msgpackWriter) writeUint(u uint64) {
+	switch {
+	case u <= 0x7f:
+		w.b = append(w.b, byte(u))
+	case u <= math.MaxUint8:
+		w.b = append(w.b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, 0xcd), uint16(u))
+	case u <= math.MaxUint32:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, 0xce), uint32(u))
+	default:
+		w.b = binary.BigEndian.AppendUint64(append(w.b, 0xcf), u)
+	}
+}
+
+func (w *msgpackWriter) writeFloat32(f float32) {
+	w.b = binary.BigEndian.AppendUint32(append(w.b, 0xca), math.Float32bits(f))
+}
+
+func (w *msgpackWriter) writeFloat64(f float64) {
+	w.b = binary.BigEndian.AppendUint64(append(w.b, 0xcb), math.Float64bits(f))
+}
+
+func (w *msgpackWriter) writeString(s string) {
+	switch n := len(s); {
+	case n <= 31:
+		w.b = append(w.b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		w.b = append(w.b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, 0xda), uint16(n))
+	default:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, 0xdb), uint32(n))
+	}
+	w.b = append(w.b, s...)
+}
+
+func (w *msgpackWriter) writeBytes(b []byte) {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		w.b = append(w.b, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, 0xc5), uint16(n))
+	default:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, 0xc6), uint32(n))
+	}
+	w.b = append(w.b, b...)
+}
+
+func (w *msgpackWriter) writeArrayHeader(n int) {
+	w.writeHeader(n, 0x90, 0xdc, 0xdd)
+}
+
+func (w *msgpackWriter) writeMapHeader(n int) {
+	w.writeHeader(n, 0x80, 0xde, 0xdf)
+}
+
+func (w *msgpackWriter) writeHeader(n int, fix, code16, code32 byte) {
+	switch {
+	case n <= 15:
+		w.b = append(w.b, fix|byte(n))
+	case n <= math.MaxUint16:
+		w.b = binary.BigEndian.AppendUint16(append(w.b, code16), uint16(n))
+	default:
+		w.b = binary.BigEndian.AppendUint32(append(w.b, code32), uint32(n))
+	}
+}
+
+func (w *msgpackWriter) writeRaw(b []byte) {
+	w.b = append(w.b, b...)
+}
+
+type msgpackReader struct {
+	byteReader
+}
+
+func (r *msgpackReader) readItem() (item, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return item{}, err
+	}
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return item{kind: kindUint, u: uint64(c)}, nil
+	case c <= 0x8f:
+		return r.container(kindMap, uint64(c&0x0f))
+	case c <= 0x9f:
+		return r.container(kindArray, uint64(c&0x0f))
+	case c <= 0xbf:
+		return r.bytes(kindString, uint64(c&0x1f))
+	case c >= 0xe0:
+		return item{kind: kindInt, i: int64(int8(c))}, nil
+	}
+	switch c {
+	case 0xc0:
+		return item{kind: kindNil}, nil
+	case 0xc2, 0xc3:
+		return item{kind: kindBool, b: c == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := r.uint(1 << (c - 0xc4))
+		if err != nil {
+			return item{}, err
+		}
+		return r.bytes(kindBytes, n)
+	case 0xca:
+		u, err := r.uint(4)
+		return item{kind: kindFloat, f: float64(math.Float32frombits(uint32(u)))}, err
+	case 0xcb:
+		u, err := r.uint(8)
+		return item{kind: kindFloat, f: math.Float64frombits(u)}, err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := r.uint(1 << (c - 0xcc))
+		return item{kind: kindUint, u: u}, err
+	case 0xd0:
+		u, err := r.uint(1)
+		return item{kind: kindInt, i: int64(int8(u))}, err
+	case 0xd1:
+		u, err := r.uint(2)
+		return item{kind: kindInt, i: int64(int16(u))}, err
+	case 0xd2:
+		u, err := r.uint(4)
+		return item{kind: kindInt, i: int64(int32(u))}, err
+	case 0xd3:
+		u, err := r.uint(8)
+		return item{kind: kindInt, i: int64(u)}, err
+	case 0xd9, 0xda, 0xdb:
+		n, err := r.uint(1 << (c - 0xd9))
+		if err != nil {
+			return item{}, err
+		}
+		return r.bytes(kindString, n)
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		if err != nil {
+			return item{}, err
+		}
+		return r.container(kindArray, n)
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		if err != nil {
+			return item{}, err
+		}
+		return r.container(kindMap, n)
+	}
+	return item{}, fmt.Errorf("codec: unsupported msgpack type 0x%02x", c)
+}
@@ -0,0 +1,848 @@
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The binary codecs share the reflection below and only differ in how items are written and read
+
+type itemKind int
+
+const (
+	kindNil itemKind = iota
+	kindBool
+	kindInt
+	kindUint
+	kindFloat
+	kindString
+	kindBytes
+	kindArray
+	kindMap
+)
+
+var kindNames = [...]string{"nil", "bool", "int", "uint", "float", "string", "bytes", "array", "map"}
+
+func (k itemKind) String() string {
+	return kindNames[k]
+}
+
+// item is the head of an encoded value; data points into the decoded buffer, n counts array elements or map pairs
+type item struct {
+	kind itemKind
+	b    bool
+	i    int64
+	u    uint64
+	f    float64
+	data []byte
+	n    int
+}
+
+type itemWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(i int64)
+	writeUint(u uint64)
+	writeFloat32(f float32)
+	writeFloat64(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+	writeRaw(b []byte)
+}
+
+type itemReader interface {
+	readItem() (item, error)
+	offset() int
+	data() []byte
+}
+
+// maxDepth limits nesting, so hostile input cannot exhaust the stack
+const maxDepth = 1000
+
+var (
+	errTooDeep       = errors.New("codec: nesting too deep")
+	errUnexpectedEnd = errors.New("codec: unexpected end of data")
+)
+
+var (
+	rawMessageType      = reflect.TypeOf(RawMessage(nil))
+	jsonNumberType      = reflect.TypeOf(json.Number(""))
+	jsonMarshalerType   = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+type encoder struct {
+	w     itemWriter
+	depth int
+}
+
+func encode(w itemWriter, v any) error {
+	e := &encoder{w: w}
+	return e.encode(reflect.ValueOf(v))
+}
+
+func (e *encoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.w.writeNil()
+		return nil
+	}
+	e.depth++
+	defer func() { e.depth-- }()
+	if e.depth > maxDepth {
+		return errTooDeep
+	}
+	t := v.Type()
+	switch {
+	case t == rawMessageType:
+		if v.IsNil() {
+			e.w.writeNil()
+		} else {
+			e.w.writeRaw(v.Bytes())
+		}
+		return nil
+	case t == jsonNumberType:
+		return e.encodeNumber(json.Number(v.String()))
+	case (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil():
+		e.w.writeNil()
+		return nil
+	case t.Implements(jsonMarshalerType):
+		return e.encodeJSON(v.Interface().(json.Marshaler))
+	case t.Implements(textMarshalerType):
+		return e.encodeText(v.Interface().(encoding.TextMarshaler))
+	case v.CanAddr() && reflect.PointerTo(t).Implements(jsonMarshalerType):
+		return e.encodeJSON(v.Addr().Interface().(json.Marshaler))
+	case v.CanAddr() && reflect.PointerTo(t).Implements(textMarshalerType):
+		return e.encodeText(v.Addr().Interface().(encoding.TextMarshaler))
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		e.w.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.w.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.w.writeUint(v.Uint())
+	case reflect.Float32:
+		e.w.writeFloat32(float32(v.Float()))
+	case reflect.Float64:
+		e.w.writeFloat64(v.Float())
+	case reflect.String:
+		e.w.writeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.w.writeNil()
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			e.w.writeBytes(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.w.writeNil()
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	case reflect.Ptr, reflect.Interface:
+		return e.encode(v.Elem())
+	default:
+		return fmt.Errorf("codec: unsupported type %v", t)
+	}
+	return nil
+}
+
+func (e *encoder) encodeArray(v reflect.Value) error {
+	e.w.writeArrayHeader(v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encodeMap writes keys as strings like encoding/json, sorted so the output is deterministic
+func (e *encoder) encodeMap(v reflect.Value) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKeyString(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	e.w.writeMapHeader(len(entries))
+	for _, entry := range entries {
+		e.w.writeString(entry.key)
+		if err := e.encode(entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapKeyString(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if tm, ok := k.Interface().(encoding.TextMarshaler); ok {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
+		}
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("codec: unsupported map key type %v", k.Type())
+}
+
+func (e *encoder) encodeStruct(v reflect.Value) error {
+	fields := cachedFields(v.Type())
+	values := make([]reflect.Value, len(fields))
+	n := 0
+	for i, f := range fields {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok || (f.omitEmpty && isEmptyValue(fv)) {
+			continue
+		}
+		values[i] = fv
+		n++
+	}
+	e.w.writeMapHeader(n)
+	for i, f := range fields {
+		if !values[i].IsValid() {
+			continue
+		}
+		e.w.writeString(f.name)
+		if err := e.encode(values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) encodeText(tm encoding.TextMarshaler) error {
+	text, err := tm.MarshalText()
+	if err != nil {
+		return err
+	}
+	e.w.writeString(string(text))
+	return nil
+}
+
+// encodeJSON re-encodes the output of MarshalJSON, so custom JSON encodings keep working with binary codecs
+func (e *encoder) encodeJSON(m json.Marshaler) error {
+	b, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		e.w.writeString(s)
+		return nil
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var x any
+	if err := d.Decode(&x); err != nil {
+		return err
+	}
+	return e.encode(reflect.ValueOf(x))
+}
+
+func (e *encoder) encodeNumber(n json.Number) error {
+	if i, err := n.Int64(); err == nil {
+		e.w.writeInt(i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		e.w.writeUint(u)
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	e.w.writeFloat64(f)
+	return nil
+}
+
+type decoder struct {
+	r     itemReader
+	depth int
+}
+
+func decode(r itemReader, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("codec: Unmarshal needs a non-nil pointer, got %T", v)
+	}
+	d := &decoder{r: r}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.r.offset() != len(d.r.data()) {
+		return errors.New("codec: trailing data")
+	}
+	return nil
+}
+
+func (d *decoder) decode(v reflect.Value) error {
+	start := d.r.offset()
+	it, err := d.r.readItem()
+	if err != nil {
+		return err
+	}
+	return d.decodeItem(it, start, v)
+}
+
+func (d *decoder) decodeItem(it item, start int, v reflect.Value) error {
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDepth {
+		return errTooDeep
+	}
+	t := v.Type()
+	if t == rawMessageType {
+		if err := d.skipChildren(it); err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), d.r.data()[start:d.r.offset()]...))
+		return nil
+	}
+	if it.kind == kindNil {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+			v.Set(reflect.Zero(t))
+		}
+		return nil
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return d.decodeItem(it, start, v.Elem())
+	}
+	if v.CanAddr() {
+		if pt := reflect.PointerTo(t); pt.Implements(jsonUnmarshalerType) {
+			return d.decodeJSON(it, start, v.Addr().Interface().(json.Unmarshaler))
+		} else if pt.Implements(textUnmarshalerType) && (it.kind == kindString || it.kind == kindBytes) {
+			return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText(it.data)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() > 0 {
+			return decodeError(it, t)
+		}
+		//decode into a pointer held by the interface like encoding/json does, Output.Result relies on it
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			return d.decodeItem(it, start, v.Elem().Elem())
+		}
+		x, err := d.generic(it)
+		if err != nil {
+			return err
+		}
+		if x == nil {
+			v.Set(reflect.Zero(t))
+		} else {
+			v.Set(reflect.ValueOf(x))
+		}
+	case reflect.Bool:
+		if it.kind != kindBool {
+			return decodeError(it, t)
+		}
+		v.SetBool(it.b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := itemInt(it)
+		if !ok || v.OverflowInt(i) {
+			return decodeError(it, t)
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u, ok := itemUint(it)
+		if !ok || v.OverflowUint(u) {
+			return decodeError(it, t)
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, ok := itemFloat(it)
+		if !ok {
+			return decodeError(it, t)
+		}
+		v.SetFloat(f)
+	case reflect.String:
+		if t == jsonNumberType && (it.kind == kindInt || it.kind == kindUint || it.kind == kindFloat) {
+			x, _ := d.generic(it)
+			v.SetString(fmt.Sprint(x))
+			return nil
+		}
+		if it.kind != kindString && it.kind != kindBytes {
+			return decodeError(it, t)
+		}
+		v.SetString(string(it.data))
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 && (it.kind == kindBytes || it.kind == kindString) {
+			v.SetBytes(append([]byte{}, it.data...))
+			return nil
+		}
+		if it.kind != kindArray {
+			return decodeError(it, t)
+		}
+		//existing elements are decoded into like encoding/json does, CallSingle relies on it
+		s := v
+		if v.IsNil() || v.Len() < it.n {
+			s = reflect.MakeSlice(t, it.n, it.n)
+			reflect.Copy(s, v)
+		} else {
+			s = v.Slice(0, it.n)
+		}
+		for i := 0; i < it.n; i++ {
+			if err := d.decode(s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Array:
+		if it.kind != kindArray {
+			return decodeError(it, t)
+		}
+		for i := 0; i < it.n; i++ {
+			if i >= v.Len() {
+				if err := d.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		for i := it.n; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(t.Elem()))
+		}
+	case reflect.Map:
+		if it.kind != kindMap {
+			return decodeError(it, t)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(t, it.n))
+		}
+		for i := 0; i < it.n; i++ {
+			key := reflect.New(t.Key()).Elem()
+			if err := d.decodeMapKey(key); err != nil {
+				return err
+			}
+			value := reflect.New(t.Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+	case reflect.Struct:
+		if it.kind != kindMap {
+			return decodeError(it, t)
+		}
+		fields := cachedFields(t)
+		for i := 0; i < it.n; i++ {
+			keyItem, err := d.r.readItem()
+			if err != nil {
+				return err
+			}
+			f := (*field)(nil)
+			if keyItem.kind == kindString {
+				f = findField(fields, keyItem.data)
+			} else if err := d.skipChildren(keyItem); err != nil {
+				return err
+			}
+			if f == nil {
+				if err := d.skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			fv, ok := fieldByIndex(v, f.index, true)
+			if !ok {
+				err = d.skip()
+			} else {
+				err = d.decode(fv)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return decodeError(it, t)
+	}
+	return nil
+}
+
+// decodeMapKey accepts string keys for integer and TextUnmarshaler key types like encoding/json, and native keys of other encoders
+func (d *decoder) decodeMapKey(key reflect.Value) error {
+	start := d.r.offset()
+	it, err := d.r.readItem()
+	if err != nil {
+		return err
+	}
+	if it.kind == kindString && key.Kind() != reflect.String {
+		if tu, ok := key.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			return tu.UnmarshalText(it.data)
+		}
+		switch key.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i, err := strconv.ParseInt(string(it.data), 10, 64)
+			if err != nil || key.OverflowInt(i) {
+				return decodeError(it, key.Type())
+			}
+			key.SetInt(i)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			u, err := strconv.ParseUint(string(it.data), 10, 64)
+			if err != nil || key.OverflowUint(u) {
+				return decodeError(it, key.Type())
+			}
+			key.SetUint(u)
+			return nil
+		}
+	}
+	return d.decodeItem(it, start, key)
+}
+
+// decodeJSON passes a value to UnmarshalJSON as JSON
+func (d *decoder) decodeJSON(it item, start int, u json.Unmarshaler) error {
+	x, err := d.generic(it)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(x)
+	if err != nil {
+		return err
+	}
+	return u.UnmarshalJSON(b)
+}
+
+// generic decodes into the types encoding/json uses for any, except that integers stay int64 or uint64
+// and byte strings stay []byte
+func (d *decoder) generic(it item) (any, error) {
+	switch it.kind {
+	case kindNil:
+		return nil, nil
+	case kindBool:
+		return it.b, nil
+	case kindInt:
+		return it.i, nil
+	case kindUint:
+		if it.u <= math.MaxInt64 {
+			return int64(it.u), nil
+		}
+		return it.u, nil
+	case kindFloat:
+		return it.f, nil
+	case kindString:
+		return string(it.data), nil
+	case kindBytes:
+		return append([]byte{}, it.data...), nil
+	case kindArray:
+		a := make([]any, it.n)
+		for i := range a {
+			if err := d.decode(reflect.ValueOf(&a[i]).Elem()); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case kindMap:
+		m := make(map[string]any, it.n)
+		for i := 0; i < it.n; i++ {
+			var key, value any
+			if err := d.decode(reflect.ValueOf(&key).Elem()); err != nil {
+				return nil, err
+			}
+			if err := d.decode(reflect.ValueOf(&value).Elem()); err != nil {
+				return nil, err
+			}
+			if s, ok := key.(string); ok {
+				m[s] = value
+			} else {
+				m[fmt.Sprint(key)] = value
+			}
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("codec: unknown item kind %v", it.kind)
+}
+
+func (d *decoder) skip() error {
+	it, err := d.r.readItem()
+	if err != nil {
+		return err
+	}
+	return d.skipChildren(it)
+}
+
+func (d *decoder) skipChildren(it item) error {
+	n := it.n
+	switch it.kind {
+	case kindArray:
+	case kindMap:
+		n *= 2
+	default:
+		return nil
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	if d.depth > maxDepth {
+		return errTooDeep
+	}
+	for i := 0; i < n; i++ {
+		if err := d.skip(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeError(it item, t reflect.Type) error {
+	return fmt.Errorf("codec: cannot decode %v into %v", it.kind, t)
+}
+
+func itemInt(it item) (int64, bool) {
+	switch it.kind {
+	case kindInt:
+		return it.i, true
+	case kindUint:
+		return int64(it.u), it.u <= math.MaxInt64
+	case kindFloat:
+		return int64(it.f), it.f == math.Trunc(it.f) && it.f >= math.MinInt64 && it.f < math.MaxInt64
+	}
+	return 0, false
+}
+
+func itemUint(it item) (uint64, bool) {
+	switch it.kind {
+	case kindUint:
+		return it.u, true
+	case kindInt:
+		return uint64(it.i), it.i >= 0
+	case kindFloat:
+		return uint64(it.f), it.f == math.Trunc(it.f) && it.f >= 0 && it.f < math.MaxUint64
+	}
+	return 0, false
+}
+
+func itemFloat(it item) (float64, bool) {
+	switch it.kind {
+	case kindFloat:
+		return it.f, true
+	case kindInt:
+		return float64(it.i), true
+	case kindUint:
+		return float64(it.u), true
+	}
+	return 0, false
+}
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map //reflect.Type -> []field
+
+func cachedFields(t reflect.Type) []field {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]field)
+	}
+	fields, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fields.([]field)
+}
+
+// typeFields lists the fields encoding/json would use: embedded structs without a name in the tag are flattened,
+// and a field hides fields of the same name nested deeper
+func typeFields(t reflect.Type) []field {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	var fields []field
+	names := map[string]bool{}
+	visited := map[reflect.Type]bool{}
+	for current := []embedded{{t: t}}; len(current) > 0; {
+		var next []embedded
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				sf := e.t.Field(i)
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int{}, e.index...), i)
+				if sf.Anonymous && name == "" {
+					ft := sf.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{ft, index})
+						continue
+					}
+				}
+				if !sf.IsExported() {
+					continue
+				}
+				if name == "" {
+					name = sf.Name
+				}
+				if names[name] {
+					continue
+				}
+				names[name] = true
+				fields = append(fields, field{name: name, index: index, omitEmpty: strings.Contains(","+opts+",", ",omitempty,")})
+			}
+		}
+		current = next
+	}
+	return fields
+}
+
+// findField matches a key exactly or else case-insensitively, like encoding/json
+func findField(fields []field, key []byte) *field {
+	for i := range fields {
+		if fields[i].name == string(key) {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, string(key)) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// fieldByIndex follows embedded pointers, allocating nil ones when alloc is set and reporting false otherwise
+func fieldByIndex(v reflect.Value, index []int, alloc bool) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !alloc || !v.CanSet() {
+					return reflect.Value{}, false
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// byteReader is the input of a binary codec
+type byteReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *byteReader) offset() int {
+	return r.pos
+}
+
+func (r *byteReader) data() []byte {
+	return r.b
+}
+
+func (r *byteReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(r.b)-r.pos {
+		return nil, errUnexpectedEnd
+	}
+	b := r.b[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes
+func (r *byteReader) uint(n int) (uint64, error) {
+	b, err := r.next(n)
+	if err != nil {
+		return 0, err
+	}
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+	return u, nil
+}
+
+func (r *byteReader) bytes(kind itemKind, n uint64) (item, error) {
+	if n > uint64(len(r.b)-r.pos) {
+		return item{}, errUnexpectedEnd
+	}
+	b, _ := r.next(int(n))
+	return item{kind: kind, data: b}, nil
+}
+
+// container checks n against the remaining data, every element takes at least a byte
+func (r *byteReader) container(kind itemKind, n uint64) (item, error) {
+	least := n
+	if kind == kindMap {
+		least *= 2
+	}
+	if n > math.MaxInt32 || least > uint64(len(r.b)-r.pos) {
+		return item{}, errUnexpectedEnd
+	}
+	return item{kind: kind, n: int(n)}, nil
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/namitos/rpc/packets"
+)
+
+const CompressionGzip = "gzip"
+
+// DefaultCompressionThreshold is the smallest payload worth compressing unless configured otherwise
+const DefaultCompressionThreshold = 1024
+
+var gzipWriters = sync.Pool{
+	New: func() any {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func gzipCompress(body []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(body)/4))
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipDecompress fails with packets.ErrTooLarge when the decompressed payload exceeds maxLength
+func gzipDecompress(r io.Reader, maxLength uint64) ([]byte, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	defer zr.Close()
+	body, err := io.ReadAll(io.LimitReader(zr, int64(maxLength)+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	if uint64(len(body)) > maxLength {
+		return nil, packets.ErrTooLarge
+	}
+	return body, nil
+}
+
+func compressionThreshold(threshold int) int {
+	if threshold == 0 {
+		return DefaultCompressionThreshold
+	}
+	return threshold
+}
+
+// compressPayload compresses body when the session allows it and the result is smaller, flagging messageType
+func compressPayload(sess *session, body []byte, messageType uint64, threshold int) ([]byte, uint64) {
+	messageType &^= packets.FlagCompressed
+	if sess.compression == CompressionGzip && len(body) >= compressionThreshold(threshold) {
+		if compressed, err := gzipCompress(body); err == nil && len(compressed) < len(body) {
+			return compressed, messageType | packets.FlagCompressed
+		}
+	}
+	return body, messageType
+}
+
+// readFrameBody decompresses a frame body when its type is flagged compressed, releasing the compressed body
+func readFrameBody(body []byte, messageType uint64, maxLength uint64) ([]byte, error) {
+	if messageType&packets.FlagCompressed == 0 {
+		return body, nil
+	}
+	defer packets.Release(body)
+	return gzipDecompress(bytes.NewReader(body), maxLength)
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, encoding := range strings.Split(acceptEncoding, ",") {
+		encoding, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(encoding) == CompressionGzip && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
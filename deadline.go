@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// ErrIdleTimeout is returned by reads of a connection which had no calls and no traffic for its IdleTimeout
+var ErrIdleTimeout = errors.New("connection idle timeout")
+
+// Reasons a connection was closed, used in logs and the rpc_server_tcp_connections_closed_total metric
+const (
+	closeReasonEOF         = "eof"
+	closeReasonIdle        = "idle"
+	closeReasonReadTimeout = "read_timeout"
+	closeReasonTooLarge    = "too_large"
+	closeReasonProtocol    = "protocol"
+	closeReasonHeartbeat   = "heartbeat"
+	closeReasonError       = "error"
+)
+
+// deadliner is implemented by connections which support timeouts, like net.Conn
+type deadliner interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// deadlineConn applies idleTimeout while waiting for the first byte of a frame and readTimeout while reading the rest of it.
+// The idle timeout counts from the last message reported with active, so heartbeat frames do not keep a connection open,
+// and is extended as long as busy reports calls in progress on the connection.
+// Timeouts are not applied to streams without deadlines
+type deadlineConn struct {
+	io.ReadWriteCloser
+	deadlines    deadliner
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+	busy         func() bool
+	waiting      bool
+	activeAt     time.Time
+}
+
+func newDeadlineConn(connection io.ReadWriteCloser, readTimeout, writeTimeout, idleTimeout time.Duration, busy func() bool) *deadlineConn {
+	deadlines, _ := connection.(deadliner)
+	return &deadlineConn{
+		ReadWriteCloser: connection,
+		deadlines:       deadlines,
+		readTimeout:     readTimeout,
+		writeTimeout:    writeTimeout,
+		idleTimeout:     idleTimeout,
+		busy:            busy,
+		waiting:         true,
+		activeAt:        time.Now(),
+	}
+}
+
+// active restarts the idle timeout after a message which is not a heartbeat
+func (c *deadlineConn) active() {
+	c.activeAt = time.Now()
+}
+
+// startFrame marks the next Read as the beginning of a new frame
+func (c *deadlineConn) startFrame() {
+	c.waiting = true
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	if c.deadlines == nil {
+		return c.ReadWriteCloser.Read(p)
+	}
+	for {
+		switch {
+		case c.waiting && c.idleTimeout > 0:
+			c.deadlines.SetReadDeadline(c.activeAt.Add(c.idleTimeout))
+		case !c.waiting && c.readTimeout > 0:
+			c.deadlines.SetReadDeadline(time.Now().Add(c.readTimeout))
+		case c.readTimeout > 0 || c.idleTimeout > 0:
+			c.deadlines.SetReadDeadline(time.Time{})
+		}
+		n, err := c.ReadWriteCloser.Read(p)
+		if n > 0 {
+			c.waiting = false
+		}
+		if n == 0 && c.waiting && isTimeout(err) {
+			if c.busy != nil && c.busy() {
+				c.active()
+				continue
+			}
+			return n, ErrIdleTimeout
+		}
+		return n, err
+	}
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.writeTimeout > 0 && c.deadlines != nil {
+		c.deadlines.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+	return c.ReadWriteCloser.Write(p)
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func closeReason(err error) string {
+	switch {
+	case errors.Is(err, ErrProtocol):
+		return closeReasonProtocol
+	case errors.Is(err, ErrIdleTimeout):
+		return closeReasonIdle
+	case errors.Is(err, ErrHeartbeatTimeout):
+		return closeReasonHeartbeat
+	case isTimeout(err):
+		return closeReasonReadTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, net.ErrClosed):
+		return closeReasonEOF
+	}
+	return closeReasonError
+}
@@ -0,0 +1,67 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/namitos/rpc/codec"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	ErrorCodeParse          int64 = -32700
+	ErrorCodeInvalidRequest int64 = -32600
+	ErrorCodeMethodNotFound int64 = -32601
+	ErrorCodeInvalidParams  int64 = -32602
+	ErrorCodeInternal       int64 = -32603
+	// ErrorCodeServer is the code of errors returned by methods which are not an OutputError
+	ErrorCodeServer int64 = -32000
+)
+
+var errMessageTooLarge = &OutputError{Code: ErrorCodeInvalidRequest, Message: "message too large"}
+
+// Client side failures; use errors.Is as they are usually wrapped with details
+var (
+	// ErrDisconnected fails calls waiting for a response when their connection is lost
+	ErrDisconnected = errors.New("connection lost")
+	ErrNotConnected = errors.New("client not connected")
+	// ErrClientClosed fails calls on a client after Close
+	ErrClientClosed = errors.New("client closed")
+	// ErrTimeout is returned together with context.DeadlineExceeded when the call context expires
+	ErrTimeout = errors.New("call timed out")
+	// ErrProtocol is returned for a response which cannot be decoded
+	ErrProtocol = errors.New("protocol error")
+)
+
+// toOutputError keeps JSON-RPC errors as they are and reports others as internal errors
+func toOutputError(err error) *OutputError {
+	outputError := &OutputError{}
+	if errors.As(err, &outputError) {
+		return outputError
+	}
+	return &OutputError{Code: ErrorCodeInternal, Message: err.Error()}
+}
+
+// unmarshalOutput decodes a response to a batch; a single error object answered instead of it is returned as the error
+func unmarshalOutput(c codec.Codec, response []byte, result *[]Output) error {
+	if !c.IsArray(response) {
+		output := &Output{}
+		if err := c.Unmarshal(response, output); err != nil || output.Error == nil {
+			return fmt.Errorf("%w: unexpected response %.64q", ErrProtocol, response)
+		}
+		return output.Error
+	}
+	if err := c.Unmarshal(response, result); err != nil {
+		return fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	return nil
+}
+
+// contextError marks an expired call context with ErrTimeout
+func contextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, ctx.Err())
+	}
+	return ctx.Err()
+}
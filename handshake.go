@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/namitos/rpc/codec"
+	"github.com/namitos/rpc/packets"
+)
+
+const CodecJSON = codec.NameJSON
+
+// session is what both sides of a TCP connection agreed on in the handshake; legacy connections use the zero value
+type session struct {
+	version          uint16
+	codec            string
+	compression      string
+	peerMaxFrameSize uint64
+	streaming        bool
+	heartbeat        bool
+}
+
+// getCodec returns the negotiated codec, JSON for legacy connections
+func (s *session) getCodec() codec.Codec {
+	if c := codec.ByName(s.codec); c != nil {
+		return c
+	}
+	return codec.JSON
+}
+
+var supportedCompression = []string{CompressionGzip}
+
+// localHello lists the capabilities of this side, offering preferred before the other registered codecs
+func localHello(maxFrameSize uint64, compression bool, preferred codec.Codec) *packets.Hello {
+	codecs := codec.Names()
+	if preferred != nil {
+		codecs = append([]string{preferred.Name()}, codecs...)
+	}
+	hello := &packets.Hello{
+		Codecs:       codecs,
+		MaxFrameSize: maxFrameSize,
+		Streaming:    true,
+		Heartbeat:    true,
+	}
+	if compression {
+		hello.Compression = supportedCompression
+	}
+	return hello
+}
+
+// negotiate picks the capabilities used on a connection, preferring the order of the client
+func negotiate(version uint16, client *packets.Hello, local *packets.Hello) (*session, *packets.Hello) {
+	if version > packets.Version {
+		version = packets.Version
+	}
+	s := &session{
+		version:          version,
+		codec:            firstSupported(client.Codecs, local.Codecs),
+		compression:      firstSupported(client.Compression, local.Compression),
+		peerMaxFrameSize: client.MaxFrameSize,
+		streaming:        client.Streaming && local.Streaming,
+		heartbeat:        client.Heartbeat && local.Heartbeat,
+	}
+	if s.codec == "" {
+		s.codec = CodecJSON
+	}
+	server := &packets.Hello{
+		Codecs:       []string{s.codec},
+		MaxFrameSize: local.MaxFrameSize,
+		Streaming:    s.streaming,
+		Heartbeat:    s.heartbeat,
+	}
+	if s.compression != "" {
+		server.Compression = []string{s.compression}
+	}
+	return s, server
+}
+
+// acceptSession applies the answer of the server to the client side
+func acceptSession(version uint16, server *packets.Hello) (*session, error) {
+	if version > packets.Version {
+		return nil, fmt.Errorf("%w: unsupported protocol version %v", ErrProtocol, version)
+	}
+	s := &session{version: version, codec: CodecJSON, peerMaxFrameSize: server.MaxFrameSize, streaming: server.Streaming, heartbeat: server.Heartbeat}
+	if len(server.Codecs) > 0 {
+		s.codec = firstSupported(server.Codecs, codec.Names())
+		if s.codec == "" {
+			return nil, fmt.Errorf("%w: unsupported codec %v", ErrProtocol, server.Codecs)
+		}
+	}
+	if len(server.Compression) > 0 {
+		s.compression = firstSupported(server.Compression, supportedCompression)
+		if s.compression == "" {
+			return nil, fmt.Errorf("%w: unsupported compression %v", ErrProtocol, server.Compression)
+		}
+	}
+	return s, nil
+}
+
+func firstSupported(preferred, supported []string) string {
+	for _, p := range preferred {
+		for _, s := range supported {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return ""
+}
+
+// prefixReader returns bytes which were already read from a stream before reading from it again
+type prefixReader struct {
+	io.Reader
+	prefix []byte
+}
+
+func (r *prefixReader) Read(p []byte) (int, error) {
+	if len(r.prefix) > 0 {
+		n := copy(p, r.prefix)
+		r.prefix = r.prefix[n:]
+		return n, nil
+	}
+	return r.Reader.Read(p)
+}
@@ -0,0 +1,211 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const MethodHealthCheck = "health.check"
+
+const (
+	HealthStatusOK       = "ok"
+	HealthStatusFail     = "fail"
+	HealthStatusDraining = "draining"
+)
+
+type HealthCheckFn func(ctx context.Context) error
+
+type HealthReport struct {
+	Status string                       `json:"status"`
+	Ready  bool                         `json:"ready"`
+	Checks map[string]HealthCheckResult `json:"checks,omitempty"`
+}
+
+type HealthCheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthState struct {
+	checks   map[string]HealthCheckFn
+	checksMu sync.RWMutex
+	draining atomic.Bool
+	calls    atomic.Int64
+	unqueued atomic.Int64 //TCP messages whose response is not queued for writing yet
+	conns    map[uint64]*trackedConn
+	connsMu  sync.Mutex
+}
+
+// trackedConn is an open connection; its writer, once it has one, flushes queued responses before a graceful close
+type trackedConn struct {
+	connection io.Closer
+	writer     *frameWriter
+}
+
+// AddHealthCheck registers a check reported by health.check and /readyz; a check with the same name is replaced
+func (h *Server) AddHealthCheck(name string, fn HealthCheckFn) {
+	h.health.checksMu.Lock()
+	defer h.health.checksMu.Unlock()
+	if h.health.checks == nil {
+		h.health.checks = map[string]HealthCheckFn{}
+	}
+	h.health.checks[name] = fn
+}
+
+// CheckHealth runs all registered checks concurrently. The server is ready when every check passes and it is not draining
+func (h *Server) CheckHealth(ctx context.Context) *HealthReport {
+	h.health.checksMu.RLock()
+	names := make([]string, 0, len(h.health.checks))
+	fns := make([]HealthCheckFn, 0, len(h.health.checks))
+	for name, fn := range h.health.checks {
+		names = append(names, name)
+		fns = append(fns, fn)
+	}
+	h.health.checksMu.RUnlock()
+
+	results := make([]HealthCheckResult, len(fns))
+	wg := sync.WaitGroup{}
+	wg.Add(len(fns))
+	for i, fn := range fns {
+		go func(i int, fn HealthCheckFn) {
+			defer wg.Done()
+			results[i] = HealthCheckResult{Status: HealthStatusOK}
+			if err := fn(ctx); err != nil {
+				results[i] = HealthCheckResult{Status: HealthStatusFail, Error: err.Error()}
+			}
+		}(i, fn)
+	}
+	wg.Wait()
+
+	report := &HealthReport{Status: HealthStatusOK, Ready: true}
+	if len(names) > 0 {
+		report.Checks = make(map[string]HealthCheckResult, len(names))
+	}
+	for i, name := range names {
+		report.Checks[name] = results[i]
+		if results[i].Status != HealthStatusOK {
+			report.Status = HealthStatusFail
+			report.Ready = false
+		}
+	}
+	if h.health.draining.Load() {
+		report.Status = HealthStatusDraining
+		report.Ready = false
+	}
+	return report
+}
+
+// HandleHealthz is a liveness probe: it answers 200 for as long as the process serves requests
+func (h *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	setDefaultHeaders(w)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// HandleReadyz is a readiness probe: it runs the registered checks and answers 503 when they fail or the server is draining
+func (h *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := h.CheckHealth(r.Context())
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		SendAPIError(w, err)
+		return
+	}
+	setDefaultHeaders(w)
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(reportJSON)
+}
+
+func (h *Server) setHealthBuiltins() {
+	h.setBuiltin(MethodHealthCheck, func(ctx context.Context) *HealthReport {
+		return h.CheckHealth(ctx)
+	}, func(h *Server) bool { return true })
+}
+
+func (h *Server) trackConnection(connID uint64, connection io.Closer) {
+	h.health.connsMu.Lock()
+	defer h.health.connsMu.Unlock()
+	if h.health.conns == nil {
+		h.health.conns = map[uint64]*trackedConn{}
+	}
+	h.health.conns[connID] = &trackedConn{connection: connection}
+}
+
+func (h *Server) trackWriter(connID uint64, writer *frameWriter) {
+	h.health.connsMu.Lock()
+	defer h.health.connsMu.Unlock()
+	if tracked := h.health.conns[connID]; tracked != nil {
+		tracked.writer = writer
+	}
+}
+
+func (h *Server) untrackConnection(connID uint64) {
+	h.health.connsMu.Lock()
+	defer h.health.connsMu.Unlock()
+	delete(h.health.conns, connID)
+}
+
+// Shutdown marks the server as draining, so /readyz and health.check report not ready, stops accepting TCP connections
+// and waits for running calls to finish, then closes open connections once their responses are written.
+// Connections are closed right away when ctx is done
+func (h *Server) Shutdown(ctx context.Context) error {
+	h.health.draining.Store(true)
+	err := h.CloseTCP()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for h.health.calls.Load() > 0 || h.health.unqueued.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			h.closeConnections()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		h.drainConnections()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return err
+	case <-ctx.Done():
+		h.closeConnections()
+		return ctx.Err()
+	}
+}
+
+// drainConnections flushes the queued responses of every connection and closes it
+func (h *Server) drainConnections() {
+	h.health.connsMu.Lock()
+	tracked := make([]trackedConn, 0, len(h.health.conns))
+	for _, c := range h.health.conns {
+		tracked = append(tracked, *c) //the writer is set by trackWriter under the lock
+	}
+	h.health.connsMu.Unlock()
+	wg := sync.WaitGroup{}
+	wg.Add(len(tracked))
+	for _, c := range tracked {
+		go func(c trackedConn) {
+			defer wg.Done()
+			if c.writer != nil {
+				c.writer.close()
+			}
+			c.connection.Close()
+		}(c)
+	}
+	wg.Wait()
+}
+
+func (h *Server) closeConnections() {
+	h.health.connsMu.Lock()
+	defer h.health.connsMu.Unlock()
+	for _, c := range h.health.conns {
+		c.connection.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/namitos/rpc/packets"
+)
+
+// DefaultHeartbeatMisses is the number of heartbeat intervals in a row without a frame from the peer
+// which close a connection unless configured otherwise
+const DefaultHeartbeatMisses = 3
+
+// ErrHeartbeatTimeout is returned for a connection closed because its peer stopped answering pings
+var ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
+// heartbeat pings the peer of a connection every interval and closes the connection when nothing arrived from it
+// for misses intervals in a row. Any frame counts, a pong is only the answer of an otherwise quiet peer
+type heartbeat struct {
+	alive   atomic.Bool
+	expired atomic.Bool
+	stop    chan struct{}
+}
+
+// startHeartbeat pings through writer when the session negotiated heartbeats and interval is set; nil otherwise.
+// close is called to tear the connection down once the peer is considered dead
+func startHeartbeat(sess *session, writer *frameWriter, interval time.Duration, misses int, close func()) *heartbeat {
+	if !sess.heartbeat || interval <= 0 {
+		return nil
+	}
+	if misses <= 0 {
+		misses = DefaultHeartbeatMisses
+	}
+	hb := &heartbeat{stop: make(chan struct{})}
+	go hb.run(writer, interval, misses, close)
+	return hb
+}
+
+func (hb *heartbeat) run(writer *frameWriter, interval time.Duration, misses int, close func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for pingID := uint64(1); ; pingID++ {
+		select {
+		case <-hb.stop:
+			return
+		case <-ticker.C:
+		}
+		if hb.alive.Swap(false) || pingID == 1 { //no ping was out during the first interval
+			missed = 0
+		} else if missed++; missed >= misses {
+			hb.expired.Store(true)
+			close()
+			return
+		}
+		if err := writer.write(outFrame{nil, packets.TypePing, pingID}); err != nil {
+			return
+		}
+	}
+}
+
+// received records a frame from the peer
+func (hb *heartbeat) received() {
+	if hb != nil {
+		hb.alive.Store(true)
+	}
+}
+
+// err replaces the read error of a connection closed by the heartbeat
+func (hb *heartbeat) err(err error) error {
+	if hb != nil && hb.expired.Load() {
+		return ErrHeartbeatTimeout
+	}
+	return err
+}
+
+func (hb *heartbeat) close() {
+	if hb != nil {
+		close(hb.stop)
+	}
+}
+
+// controlFrame answers a ping on writer and reports whether messageType is a control frame rather than a message
+func controlFrame(writer *frameWriter, messageType, messageID uint64) bool {
+	switch messageType & packets.TypeMask {
+	case packets.TypePing:
+		writer.write(outFrame{nil, packets.TypePong, messageID})
+		return true
+	case packets.TypePong:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package rpc
+
+import (
+	"sort"
+
+	"github.com/namitos/rpc/schema"
+)
+
+// Built-in methods answered by every Server unless turned off
+const (
+	MethodDiscover     = "rpc.discover"
+	MethodListMethods  = "system.listMethods"
+	MethodMethodSchema = "system.methodSchema"
+)
+
+type builtinMethod struct {
+	*methodHandler
+	enabled func(h *Server) bool
+}
+
+// setBuiltin registers a method which is resolved after the user defined ones and is not a part of the schema document
+func (h *Server) setBuiltin(name string, fn any, enabled func(h *Server) bool) {
+	h.builtins[name] = &builtinMethod{
+		methodHandler: newMethodHandler(name, fn, schema.Map{}),
+		enabled:       enabled,
+	}
+}
+
+func (h *Server) getBuiltin(name string) *methodHandler {
+	h.builtinsOnce.Do(h.initBuiltins)
+	builtin := h.builtins[name]
+	if builtin == nil || !builtin.enabled(h) {
+		return nil
+	}
+	return builtin.methodHandler
+}
+
+func (h *Server) initBuiltins() {
+	h.builtins = map[string]*builtinMethod{}
+	h.setIntrospectionBuiltins()
+	h.setHealthBuiltins()
+	h.setAdminBuiltins()
+}
+
+type methodSchemaParams struct {
+	Name string `json:"name" validate:"required"`
+}
+
+func introspectionEnabled(h *Server) bool {
+	return !h.DisableIntrospection
+}
+
+func (h *Server) setIntrospectionBuiltins() {
+	h.setBuiltin(MethodDiscover, func() *SchemaRoot {
+		return h.getSchemaRoot()
+	}, introspectionEnabled)
+	h.setBuiltin(MethodListMethods, func() []string {
+		methods := h.GetAllMethods()
+		sort.Strings(methods)
+		return methods
+	}, introspectionEnabled)
+	h.setBuiltin(MethodMethodSchema, func(params methodSchemaParams) (*MethodSchema, error) {
+		if mh, ok := h.Load(params.Name); ok {
+			return mh.(*methodHandler).methodSchema, nil
+		}
+		return nil, &OutputError{Code: ErrorCodeInvalidParams, Message: "method not found"}
+	}, introspectionEnabled)
+}
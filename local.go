@@ -0,0 +1,141 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+
+	"github.com/namitos/rpc/codec"
+)
+
+// NewLocalClient calls srv in the same process
+func NewLocalClient(srv *Server) *LocalClient {
+	return &LocalClient{Server: srv}
+}
+
+// LocalClient calls a Server in the same process without a network. Requests and responses are encoded to JSON
+// and handled like HandleBytes does, so calls behave as they do over HTTP or TCP
+type LocalClient struct {
+	Server *Server
+	// Middleware gets the decoded params of every call, like the one passed to HandleBytes
+	Middleware func(reflect.Value)
+	// ZeroCopy skips encoding: methods get the params as they are and results are assigned to Output.Result.
+	// Params must be assignable to the method input or point to a value which is; both sides share what they pass
+	ZeroCopy bool
+
+	counter uint64
+}
+
+func (h *LocalClient) Call(ctx context.Context, input []Input, result *[]Output) error {
+	if tc, ok := TraceFromContext(ctx); ok {
+		input = withTrace(input, tc)
+	}
+	ctx = withPeer(ctx, &peer{transport: TransportLocal})
+	messageID := atomic.AddUint64(&h.counter, 1)
+	done := make(chan localResponse, 1)
+	go func() { //result is only written below, a call which outlives ctx must not touch it
+		if h.ZeroCopy {
+			done <- localResponse{outputs: h.callValues(ctx, messageID, input)}
+		} else {
+			body, err := h.callBytes(ctx, messageID, input)
+			done <- localResponse{body: body, err: err}
+		}
+	}()
+	select {
+	case response := <-done:
+		if response.err != nil {
+			return response.err
+		}
+		if h.ZeroCopy {
+			assignOutputs(response.outputs, result)
+			return nil
+		}
+		return unmarshalOutput(codec.JSON, response.body, result)
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// localResponse is the encoded response of a call, or its outputs with ZeroCopy
+type localResponse struct {
+	body    []byte
+	outputs []*Output
+	err     error
+}
+
+func (h *LocalClient) callBytes(ctx context.Context, messageID uint64, input []Input) ([]byte, error) {
+	body, err := codec.JSON.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	response, err := h.Server.handleBytes(ctx, codec.JSON, body, messageID, h.Middleware)
+	if err != nil {
+		return nil, toOutputError(err)
+	}
+	return response, nil
+}
+
+// callValues runs the calls with the values of input without encoding them
+func (h *LocalClient) callValues(ctx context.Context, messageID uint64, input []Input) []*Output {
+	items := make([]*inputPartial, len(input))
+	for i, item := range input {
+		items[i] = &inputPartial{
+			ID:          item.ID,
+			Method:      item.Method,
+			Traceparent: item.Traceparent,
+			Tracestate:  item.Tracestate,
+			value:       item.Params,
+			local:       true,
+		}
+	}
+	return h.Server.handleInputs(ctx, codec.JSON, messageID, items, len(items) > 1, h.Middleware)
+}
+
+// assignOutputs assigns the results of outputs to result without encoding them
+func assignOutputs(outputs []*Output, result *[]Output) {
+	if len(*result) < len(outputs) {
+		*result = append(*result, make([]Output, len(outputs)-len(*result))...)
+	}
+	for i, output := range outputs {
+		target := &(*result)[i]
+		target.ID = output.ID
+		target.Error = output.Error
+		if output.Error != nil || output.Result == nil {
+			continue
+		}
+		if err := assignResult(target, output.Result); err != nil {
+			target.Error = &OutputError{Code: ErrorCodeInternal, Message: err.Error()}
+		}
+	}
+}
+
+// assignResult sets the value Output.Result points to, or Output.Result itself when it is nil
+func assignResult(target *Output, result any) error {
+	if target.Result == nil {
+		target.Result = result
+		return nil
+	}
+	to := reflect.ValueOf(target.Result)
+	if to.Kind() != reflect.Ptr || to.IsNil() {
+		return fmt.Errorf("result of type %v is not a pointer", to.Type())
+	}
+	from := reflect.ValueOf(result)
+	switch {
+	case from.Type().AssignableTo(to.Elem().Type()):
+		to.Elem().Set(from)
+	case from.Kind() == reflect.Ptr && from.Type().Elem().AssignableTo(to.Elem().Type()):
+		if from.IsNil() {
+			to.Elem().SetZero()
+		} else {
+			to.Elem().Set(from.Elem())
+		}
+	default:
+		return fmt.Errorf("result of type %v cannot be assigned to %v", from.Type(), to.Type())
+	}
+	return nil
+}
+
+func (h *LocalClient) CallSingle(ctx context.Context, method string, params any, result any) error {
+	return CallSingle(h, ctx, method, params, result)
+}
@@ -0,0 +1,124 @@
+package rpc
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/namitos/rpc/schema"
+)
+
+// Values of the deprecated Server.Logging
+const (
+	LoggingErr    = "err"
+	LoggingRPCErr = "RPCErr"
+	LoggingBase   = "base"
+)
+
+// Attribute keys used in Server and TCPClient log records
+const (
+	LogKeyMethod     = "method"
+	LogKeyMessageID  = "messageID"
+	LogKeyConnID     = "connID"
+	LogKeyRemoteAddr = "remoteAddr"
+	LogKeyTransport  = "transport"
+	LogKeyDuration   = "duration"
+	LogKeyCode       = "code"
+	LogKeyBatchSize  = "batchSize"
+	LogKeyLength     = "length"
+	LogKeyURL        = "url"
+)
+
+const (
+	TransportTCP  = "tcp"
+	TransportHTTP = "http"
+	// TransportStream is any other stream served with Server.ServeConn
+	TransportStream = "stream"
+	// TransportStdio is Content-Length framed JSON served with Server.ServeStream and called with StdioClient
+	TransportStdio = "stdio"
+	// TransportLocal is a LocalClient in the same process
+	TransportLocal = "local"
+)
+
+// discardHandler drops every record; used when no Logger is configured
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+var discardLogger = slog.New(discardHandler{})
+
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
+
+// legacyLogger is the logger of the deprecated Server.Logging, created on first use
+type legacyLogger struct {
+	once   sync.Once
+	logger *slog.Logger
+}
+
+func (l *legacyLogger) get(logging schema.Enum) *slog.Logger {
+	l.once.Do(func() {
+		l.logger = slog.New(&loggingHandler{Handler: slog.Default().Handler(), logging: logging})
+	})
+	return l.logger
+}
+
+// loggingHandler passes the records selected by Server.Logging to the default slog handler, which writes to the log package
+type loggingHandler struct {
+	slog.Handler
+	logging schema.Enum
+}
+
+func (h *loggingHandler) Enabled(_ context.Context, level slog.Level) bool {
+	switch {
+	case level >= slog.LevelError:
+		return h.logging.Includes(LoggingErr)
+	case level >= slog.LevelWarn:
+		return h.logging.Includes(LoggingErr) || h.logging.Includes(LoggingRPCErr)
+	}
+	return h.logging.Includes(LoggingBase)
+}
+
+func (h *loggingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &loggingHandler{Handler: h.Handler.WithAttrs(attrs), logging: h.logging}
+}
+
+func (h *loggingHandler) WithGroup(name string) slog.Handler {
+	return &loggingHandler{Handler: h.Handler.WithGroup(name), logging: h.logging}
+}
+
+type peerKey struct{}
+
+// peer describes the connection a call came from
+type peer struct {
+	connID     uint64
+	remoteAddr string
+	transport  string
+}
+
+func withPeer(ctx context.Context, p *peer) context.Context {
+	return context.WithValue(ctx, peerKey{}, p)
+}
+
+func peerFromContext(ctx context.Context) *peer {
+	p, _ := ctx.Value(peerKey{}).(*peer)
+	return p
+}
+
+func (p *peer) logAttrs() []any {
+	if p == nil {
+		return nil
+	}
+	attrs := []any{LogKeyTransport, p.transport, LogKeyRemoteAddr, p.remoteAddr}
+	if p.connID != 0 {
+		attrs = append(attrs, LogKeyConnID, p.connID)
+	}
+	return attrs
+}
@@ -0,0 +1,239 @@
+package rpc
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	metricServerRequests          = "rpc_server_requests_total"
+	metricServerDuration          = "rpc_server_request_duration_seconds"
+	metricServerInFlight          = "rpc_server_requests_in_flight"
+	metricServerBatchSize         = "rpc_server_batch_size"
+	metricServerReceived          = "rpc_server_received_bytes_total"
+	metricServerSent              = "rpc_server_sent_bytes_total"
+	metricServerConnections       = "rpc_server_tcp_connections"
+	metricServerConnectionsClosed = "rpc_server_tcp_connections_closed_total"
+	metricClientReceived          = "rpc_client_received_bytes_total"
+	metricClientSent              = "rpc_client_sent_bytes_total"
+	metricClientReconnects        = "rpc_client_reconnects_total"
+	metricLabelUnknownMethod      = "_unknown"
+	metricLabelCodeOK             = "ok"
+)
+
+var (
+	durationBuckets  = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	batchSizeBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500}
+)
+
+const (
+	metricCounter   = "counter"
+	metricGauge     = "gauge"
+	metricHistogram = "histogram"
+)
+
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+	series  map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+}
+
+// Metrics collects Server and client statistics and exposes them in Prometheus text format.
+// A nil *Metrics is valid and collects nothing, so it can be shared by Server, TCPClient and HTTPClient or left unset
+type Metrics struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{families: map[string]*metricFamily{}}
+	m.register(metricServerRequests, "Completed calls by method and error code.", metricCounter, nil, "method", "code")
+	m.register(metricServerDuration, "Call latency by method.", metricHistogram, durationBuckets, "method")
+	m.register(metricServerInFlight, "Calls currently executing by method.", metricGauge, nil, "method")
+	m.register(metricServerBatchSize, "Number of calls per handled message.", metricHistogram, batchSizeBuckets)
+	m.register(metricServerReceived, "Bytes received by transport.", metricCounter, nil, "transport")
+	m.register(metricServerSent, "Bytes sent by transport.", metricCounter, nil, "transport")
+	m.register(metricServerConnections, "Open TCP connections.", metricGauge, nil)
+	m.register(metricServerConnectionsClosed, "Closed TCP connections by reason.", metricCounter, nil, "reason")
+	m.register(metricClientReceived, "Bytes received by clients by transport.", metricCounter, nil, "transport")
+	m.register(metricClientSent, "Bytes sent by clients by transport.", metricCounter, nil, "transport")
+	m.register(metricClientReconnects, "TCPClient reconnect attempts by endpoint.", metricCounter, nil, "url")
+	return m
+}
+
+func (m *Metrics) register(name, help, kind string, buckets []float64, labels ...string) {
+	m.families[name] = &metricFamily{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  map[string]*metricSeries{},
+	}
+}
+
+func (m *Metrics) getSeries(name string, labelValues []string) *metricSeries {
+	f := m.families[name]
+	if f == nil {
+		return nil
+	}
+	key := strings.Join(labelValues, "\xff")
+	s := f.series[key]
+	if s == nil {
+		s = &metricSeries{labelValues: labelValues}
+		if f.kind == metricHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// add increments a counter or moves a gauge by v
+func (m *Metrics) add(name string, v float64, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.getSeries(name, labelValues); s != nil {
+		s.value += v
+	}
+}
+
+func (m *Metrics) observe(name string, v float64, labelValues ...string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.getSeries(name, labelValues)
+	if s == nil {
+		return
+	}
+	for i, b := range m.families[name].buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.value += v
+}
+
+// WriteTo writes all collected metrics in Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	if m != nil {
+		m.mu.Lock()
+		names := make([]string, 0, len(m.families))
+		for name := range m.families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			m.families[name].write(cw)
+		}
+		m.mu.Unlock()
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+func (f *metricFamily) write(w io.Writer) {
+	if len(f.series) == 0 {
+		return
+	}
+	io.WriteString(w, "# HELP "+f.name+" "+f.help+"\n# TYPE "+f.name+" "+f.kind+"\n")
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != metricHistogram {
+			io.WriteString(w, f.name+formatLabels(f.labels, s.labelValues, "", "")+" "+formatFloat(s.value)+"\n")
+			continue
+		}
+		for i, b := range f.buckets {
+			io.WriteString(w, f.name+"_bucket"+formatLabels(f.labels, s.labelValues, "le", formatFloat(b))+" "+strconv.FormatUint(s.counts[i], 10)+"\n")
+		}
+		io.WriteString(w, f.name+"_bucket"+formatLabels(f.labels, s.labelValues, "le", "+Inf")+" "+strconv.FormatUint(s.count, 10)+"\n")
+		io.WriteString(w, f.name+"_sum"+formatLabels(f.labels, s.labelValues, "", "")+" "+formatFloat(s.value)+"\n")
+		io.WriteString(w, f.name+"_count"+formatLabels(f.labels, s.labelValues, "", "")+" "+strconv.FormatUint(s.count, 10)+"\n")
+	}
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	sb := strings.Builder{}
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		sb.WriteString(name + `="` + labelValueReplacer.Replace(value) + `"`)
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(extraName + `="` + extraValue + `"`)
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
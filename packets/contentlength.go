@@ -0,0 +1,66 @@
+package packets
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// ErrHeader is returned by ReadContentLength for a message without a valid Content-Length header
+var ErrHeader = errors.New("packets: invalid message header")
+
+// CreateContentLength frames a message with a Content-Length header, the way the Language Server Protocol does over stdio
+func CreateContentLength(message []byte) []byte {
+	header := "Content-Length: " + strconv.Itoa(len(message)) + "\r\n\r\n"
+	frame := make([]byte, len(header)+len(message))
+	copy(frame, header)
+	copy(frame[len(header):], message)
+	return frame
+}
+
+// ReadContentLength reads a message framed by CreateContentLength; 0 maxLength means no limit.
+// Other headers, like Content-Type, are skipped. On ErrTooLarge the message itself is left unread
+func ReadContentLength(r *bufio.Reader, maxLength uint64) ([]byte, error) {
+	length := int64(-1)
+	for lines := 0; ; lines++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if lines > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %.64q", ErrHeader, line)
+		}
+		if textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) != "Content-Length" {
+			continue
+		}
+		if length, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil || length < 0 {
+			return nil, fmt.Errorf("%w: %.64q", ErrHeader, line)
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("%w: no Content-Length", ErrHeader)
+	}
+	if maxLength > 0 && uint64(length) > maxLength {
+		return nil, ErrTooLarge
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(r, message); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return message, nil
+}
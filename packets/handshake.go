@@ -0,0 +1,110 @@
+package packets
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Message types, kept in the low byte of the type header
+const (
+	TypeMessage   uint64 = 0
+	TypeHandshake uint64 = 1
+	// TypePing asks the peer for a TypePong with the same message ID; both have no body.
+	// They are only sent on connections which agreed on Hello.Heartbeat
+	TypePing uint64 = 2
+	TypePong uint64 = 3
+	TypeMask uint64 = 0xff
+)
+
+// Flags combined with the message type
+const (
+	FlagCompressed uint64 = 1 << 8
+	// FlagMore marks a chunk of a message which is followed by more chunks on the same message ID.
+	// Chunks carry their sequence number, starting at 0, above ChunkSeqShift; the last one has no FlagMore
+	FlagMore uint64 = 1 << 9
+)
+
+const ChunkSeqShift = 32
+
+// A versioned connection opens with an 8 byte preamble in both directions: Magic and the big endian protocol Version
+// followed by 2 reserved bytes. Legacy connections start with the length header of the first message instead,
+// which begins with a zero byte for any length below 2^56, so both kinds can be served on the same port.
+// The preamble is followed by a TypeHandshake message with a JSON encoded Hello
+var Magic = [4]byte{'N', 'R', 'P', 'C'}
+
+const Version uint16 = 1
+
+const PreambleLength = 8
+
+var ErrBadHandshake = errors.New("packets: bad handshake")
+
+// Hello lists the capabilities of a side; the server answers with the subset both sides use
+type Hello struct {
+	Compression  []string `json:"compression,omitempty"`
+	Codecs       []string `json:"codecs,omitempty"`
+	MaxFrameSize uint64   `json:"maxFrameSize,omitempty"`
+	Streaming    bool     `json:"streaming,omitempty"`
+	Heartbeat    bool     `json:"heartbeat,omitempty"`
+}
+
+func Preamble(version uint16) []byte {
+	preamble := make([]byte, PreambleLength)
+	copy(preamble, Magic[:])
+	binary.BigEndian.PutUint16(preamble[4:], version)
+	return preamble
+}
+
+// ParsePreamble returns the version of a preamble or ErrBadHandshake when b does not start with Magic
+func ParsePreamble(b []byte) (uint16, error) {
+	if len(b) < PreambleLength || !bytes.Equal(b[:4], Magic[:]) {
+		return 0, ErrBadHandshake
+	}
+	version := binary.BigEndian.Uint16(b[4:])
+	if version == 0 {
+		return 0, ErrBadHandshake
+	}
+	return version, nil
+}
+
+// CreateHello returns the preamble and the handshake message
+func CreateHello(version uint16, hello *Hello) ([]byte, error) {
+	body, err := json.Marshal(hello)
+	if err != nil {
+		return nil, err
+	}
+	return append(Preamble(version), Create(body, TypeHandshake, 0)...), nil
+}
+
+// ParseHello reads the handshake message following a preamble
+func ParseHello(connection io.Reader, maxLength uint64) (*Hello, error) {
+	message, messageType, _, _, err := ParseLimit(connection, maxLength)
+	if err != nil {
+		return nil, err
+	}
+	if messageType != TypeHandshake {
+		return nil, fmt.Errorf("%w: unexpected message type %v", ErrBadHandshake, messageType)
+	}
+	hello := &Hello{}
+	if err := json.Unmarshal(message, hello); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadHandshake, err)
+	}
+	return hello, nil
+}
+
+// ReadHello reads the preamble and the handshake message
+func ReadHello(connection io.Reader, maxLength uint64) (uint16, *Hello, error) {
+	preamble := make([]byte, PreambleLength)
+	if _, err := io.ReadFull(connection, preamble); err != nil {
+		return 0, nil, err
+	}
+	version, err := ParsePreamble(preamble)
+	if err != nil {
+		return 0, nil, err
+	}
+	hello, err := ParseHello(connection, maxLength)
+	return version, hello, err
+}
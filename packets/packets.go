@@ -3,31 +3,35 @@ package packets
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
+	"math"
 	"net"
 )
 
-func Parse(connection net.Conn) ([]byte, uint64, uint64, uint64, error) {
-	lBytes := make([]byte, 8) //8*4=32;8*8=64
-	_, err := io.ReadFull(connection, lBytes)
-	if err != nil {
-		return nil, 0, 0, 0, err
-	}
-	tBytes := make([]byte, 8) //8*4=32;8*8=64
-	_, err = io.ReadFull(connection, tBytes)
-	if err != nil {
+// HeaderLength is the size of the length, type and ID fields preceding every message
+const HeaderLength = 24
+
+// ErrTooLarge is returned by ParseLimit for a message longer than allowed; the message itself is left unread
+var ErrTooLarge = errors.New("packets: message too large")
+
+// Parse reads a frame from any stream: a connection, a pipe, stdio or a buffer
+func Parse(connection io.Reader) ([]byte, uint64, uint64, uint64, error) {
+	return ParseLimit(connection, 0)
+}
+
+// ParseLimit is Parse which checks the length header against maxLength before allocating; 0 means no limit.
+// On ErrTooLarge the type, ID and length of the rejected message are still returned
+func ParseLimit(connection io.Reader, maxLength uint64) ([]byte, uint64, uint64, uint64, error) {
+	header := make([]byte, HeaderLength)
+	if _, err := io.ReadFull(connection, header); err != nil {
 		return nil, 0, 0, 0, err
 	}
-	IDBytes := make([]byte, 8) //8*4=32;8*8=64
-	_, err = io.ReadFull(connection, IDBytes)
+	length, messageType, messageID, err := parseHeader(header, maxLength)
 	if err != nil {
-		return nil, 0, 0, 0, err
+		return nil, messageType, messageID, length, err
 	}
-
-	length := binary.BigEndian.Uint64(lBytes)
-	messageType := binary.BigEndian.Uint64(tBytes)
-	messageID := binary.BigEndian.Uint64(IDBytes)
-	message := make([]byte, uint32(length))
+	message := make([]byte, length)
 	_, err = io.ReadFull(connection, message)
 	if err != nil {
 		return nil, 0, 0, 0, err
@@ -35,15 +39,27 @@ func Parse(connection net.Conn) ([]byte, uint64, uint64, uint64, error) {
 	return message, messageType, messageID, length, nil
 }
 
+func parseHeader(header []byte, maxLength uint64) (uint64, uint64, uint64, error) {
+	length := binary.BigEndian.Uint64(header)
+	messageType := binary.BigEndian.Uint64(header[8:])
+	messageID := binary.BigEndian.Uint64(header[16:])
+	if (maxLength > 0 && length > maxLength) || length > math.MaxUint32 {
+		return length, messageType, messageID, ErrTooLarge
+	}
+	return length, messageType, messageID, nil
+}
+
 func Create(message []byte, messageType, messageID uint64) []byte {
-	lBytes := make([]byte, 8)
-	length := uint64(len(message))
-	binary.BigEndian.PutUint64(lBytes, length)
-	tBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(tBytes, messageType)
-	IDBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(IDBytes, messageID)
-	return append(append(append(lBytes, tBytes...), IDBytes...), message...)
+	frame := make([]byte, HeaderLength+len(message))
+	putHeader(frame, uint64(len(message)), messageType, messageID)
+	copy(frame[HeaderLength:], message)
+	return frame
+}
+
+// Write writes a frame in a single call, so frames written by concurrent callers do not interleave when w serializes writes
+func Write(w io.Writer, message []byte, messageType, messageID uint64) error {
+	_, err := w.Write(Create(message, messageType, messageID))
+	return err
 }
 
 func Send(message []byte, messageType, messageID uint64, URL string) ([]byte, uint64, uint64, uint64, error) {
@@ -52,6 +68,13 @@ func Send(message []byte, messageType, messageID uint64, URL string) ([]byte, ui
 		return nil, 0, 0, 0, err
 	}
 	defer connection.Close()
-	connection.Write(Create(message, messageType, messageID))
-	return Parse(connection)
+	return SendOn(connection, message, messageType, messageID)
+}
+
+// SendOn writes a frame to rw and reads the answer from it
+func SendOn(rw io.ReadWriter, message []byte, messageType, messageID uint64) ([]byte, uint64, uint64, uint64, error) {
+	if err := Write(rw, message, messageType, messageID); err != nil {
+		return nil, 0, 0, 0, err
+	}
+	return Parse(rw)
 }
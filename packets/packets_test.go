@@ -0,0 +1,161 @@
+package packets
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// infiniteReader repeats data forever
+type infiniteReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *infiniteReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.data[r.pos:])
+		n += c
+		r.pos = (r.pos + c) % len(r.data)
+	}
+	return n, nil
+}
+
+func TestReaderWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	bodies := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{7}, 100000)}
+	for i, body := range bodies {
+		if i == 2 && buf.Len() != 0 {
+			t.Fatal("small frames are written before Flush")
+		}
+		if err := w.WriteFrame(body, uint64(i), uint64(i+10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	stream := append([]byte{}, buf.Bytes()...)
+	r := NewReader(buf)
+	for i, body := range bodies {
+		message, messageType, messageID, length, err := r.ReadFrame(0)
+		if err != nil || !bytes.Equal(message, body) || messageType != uint64(i) || messageID != uint64(i+10) || length != uint64(len(body)) {
+			t.Fatal(i, messageType, messageID, length, err)
+		}
+		Release(message)
+	}
+	if _, _, _, _, err := r.ReadFrame(0); !errors.Is(err, io.EOF) {
+		t.Fatal("unexpected error at the end", err)
+	}
+
+	for i, body := range bodies {
+		message, messageType, messageID, _, err := Parse(bytes.NewReader(stream))
+		if err != nil || !bytes.Equal(message, bodies[0]) || messageType != 0 || messageID != 10 {
+			t.Fatal(i, err)
+		}
+		if !bytes.Equal(Create(body, uint64(i), uint64(i+10))[HeaderLength:], body) {
+			t.Fatal("Create", i)
+		}
+	}
+
+	_, messageType, messageID, length, err := NewReader(bytes.NewReader(stream)).ReadFrame(1)
+	if !errors.Is(err, ErrTooLarge) || messageType != 0 || messageID != 10 || length != 5 {
+		t.Fatal("frame over the limit", messageType, messageID, length, err)
+	}
+}
+
+func TestContentLength(t *testing.T) {
+	stream := append(CreateContentLength([]byte(`{"a":1}`)), "content-type: application/json\r\ncontent-length: 0\r\n\r\n"...)
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for _, body := range []string{`{"a":1}`, ``} {
+		if message, err := ReadContentLength(r, 0); err != nil || string(message) != body {
+			t.Fatal(string(message), err)
+		}
+	}
+	if _, err := ReadContentLength(r, 0); !errors.Is(err, io.EOF) {
+		t.Fatal("unexpected error at the end", err)
+	}
+	for stream, expected := range map[string]error{
+		"Content-Length: 5\r\n\r\n{}":        io.ErrUnexpectedEOF,
+		"Content-Length: 5\r\n":              io.ErrUnexpectedEOF,
+		"Content-Type: text/plain\r\n\r\n{}": ErrHeader,
+		"Content-Length: -1\r\n\r\n":         ErrHeader,
+		"{}\r\n\r\n":                         ErrHeader,
+		"Content-Length: 100\r\n\r\n" + "{}": ErrTooLarge,
+	} {
+		if _, err := ReadContentLength(bufio.NewReader(strings.NewReader(stream)), 10); !errors.Is(err, expected) {
+			t.Fatalf("%q: %v", stream, err)
+		}
+	}
+}
+
+func TestBufferPool(t *testing.T) {
+	for _, n := range []int{0, 1, 512, 513, 4000, 1 << 20, 1<<20 + 1} {
+		b := GetBuffer(n)
+		if len(b) != n {
+			t.Fatal(n, len(b))
+		}
+		Release(b)
+		if b := GetBuffer(n); len(b) != n || cap(b) < n {
+			t.Fatal("reused", n, len(b), cap(b))
+		}
+	}
+	Release(make([]byte, 10, 700))
+	if b := GetBuffer(600); cap(b) < 600 {
+		t.Fatal("a released buffer is too small", cap(b))
+	}
+}
+
+func benchmarkStream(b *testing.B, size int) *infiniteReader {
+	b.Helper()
+	b.SetBytes(int64(HeaderLength + size))
+	b.ReportAllocs()
+	return &infiniteReader{data: Create(make([]byte, size), 0, 1)}
+}
+
+func BenchmarkParse(b *testing.B) {
+	conn := benchmarkStream(b, 256)
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, err := Parse(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	r := NewReader(benchmarkStream(b, 256))
+	for i := 0; i < b.N; i++ {
+		message, _, _, _, err := r.ReadFrame(0)
+		if err != nil {
+			b.Fatal(err)
+		}
+		Release(message)
+	}
+}
+
+func BenchmarkCreate(b *testing.B) {
+	body := make([]byte, 256)
+	b.SetBytes(int64(HeaderLength + len(body)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		io.Discard.Write(Create(body, 0, uint64(i)))
+	}
+}
+
+func BenchmarkWriter(b *testing.B) {
+	body := make([]byte, 256)
+	b.SetBytes(int64(HeaderLength + len(body)))
+	b.ReportAllocs()
+	w := NewWriter(io.Discard)
+	for i := 0; i < b.N; i++ {
+		if err := w.WriteFrame(body, 0, uint64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	w.Flush()
+}
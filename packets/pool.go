@@ -0,0 +1,40 @@
+package packets
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers from 512 bytes to 1 MiB are pooled in power of two size classes, larger ones are left to the GC
+const (
+	minPooledShift = 9
+	maxPooledShift = 20
+)
+
+var bufferPools [maxPooledShift - minPooledShift + 1]sync.Pool
+
+// GetBuffer returns a slice of length n, reusing a released buffer when one fits
+func GetBuffer(n int) []byte {
+	if n > 1<<maxPooledShift {
+		return make([]byte, n)
+	}
+	class := 0
+	if n > 1<<minPooledShift {
+		class = bits.Len(uint(n-1)) - minPooledShift
+	}
+	if b, ok := bufferPools[class].Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, 1<<(class+minPooledShift))
+}
+
+// Release hands a buffer back for reuse by GetBuffer; neither b nor slices of it may be used afterwards.
+// Releasing is optional, buffers which are not released are collected as usual
+func Release(b []byte) {
+	c := cap(b)
+	if c < 1<<minPooledShift || c > 1<<maxPooledShift {
+		return
+	}
+	b = b[:0]
+	bufferPools[bits.Len(uint(c))-1-minPooledShift].Put(&b)
+}
@@ -0,0 +1,74 @@
+package packets
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	readBufferSize  = 16 << 10
+	writeBufferSize = 64 << 10
+)
+
+// Reader reads frames through a buffer, taking the header of a frame in a single read.
+// Bodies come from GetBuffer; pass them to Release once done with them
+type Reader struct {
+	r      *bufio.Reader
+	header [HeaderLength]byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, readBufferSize)}
+}
+
+// Buffered is the number of bytes read from the underlying reader but not returned yet
+func (r *Reader) Buffered() int {
+	return r.r.Buffered()
+}
+
+// ReadFrame is ParseLimit for the next frame
+func (r *Reader) ReadFrame(maxLength uint64) ([]byte, uint64, uint64, uint64, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return nil, 0, 0, 0, err
+	}
+	length, messageType, messageID, err := parseHeader(r.header[:], maxLength)
+	if err != nil {
+		return nil, messageType, messageID, length, err
+	}
+	message := GetBuffer(int(length))
+	if _, err := io.ReadFull(r.r, message); err != nil {
+		Release(message)
+		return nil, 0, 0, 0, err
+	}
+	return message, messageType, messageID, length, nil
+}
+
+// Writer writes frames through a buffer without copying them into one slice first; call Flush to send them
+type Writer struct {
+	w      *bufio.Writer
+	header [HeaderLength]byte
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriterSize(w, writeBufferSize)}
+}
+
+func (w *Writer) WriteFrame(message []byte, messageType, messageID uint64) error {
+	putHeader(w.header[:], uint64(len(message)), messageType, messageID)
+	if _, err := w.w.Write(w.header[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(message)
+	return err
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func putHeader(header []byte, length, messageType, messageID uint64) {
+	binary.BigEndian.PutUint64(header, length)
+	binary.BigEndian.PutUint64(header[8:], messageType)
+	binary.BigEndian.PutUint64(header[16:], messageID)
+}
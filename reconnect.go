@@ -0,0 +1,120 @@
+package rpc
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy spaces the reconnect attempts of a TCPClient with exponential backoff
+type ReconnectPolicy struct {
+	// InitialInterval is the delay after the first failure, 100ms when 0. Each failure in a row multiplies it by Multiplier,
+	// 2 when 0, up to MaxInterval, 30s when 0
+	InitialInterval time.Duration
+	Multiplier      float64
+	MaxInterval     time.Duration
+	// Jitter spreads every delay randomly by that fraction of it, 0.2 picks one between 80% and 120%, so clients
+	// disconnected together do not reconnect together
+	Jitter float64
+	// MaxAttempts closes the client after that many attempts in a row failed to connect; 0 retries forever
+	MaxAttempts int
+}
+
+// delay is the wait before the next attempt after failures attempts in a row failed
+func (p *ReconnectPolicy) delay(failures int) time.Duration {
+	interval := p.InitialInterval
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	maxInterval := p.MaxInterval
+	if maxInterval <= 0 {
+		maxInterval = 30 * time.Second
+	}
+	d := math.Min(float64(interval)*math.Pow(multiplier, float64(failures-1)), float64(maxInterval))
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// ConnState is the state of the connection of a TCPClient
+type ConnState int
+
+const (
+	// StateIdle is a client which was not started yet, or whose connection was closed by IdleTimeout until the next call
+	StateIdle ConnState = iota
+	StateConnecting
+	// StateReady is a connection which calls are sent on
+	StateReady
+	// StateDisconnected is a lost connection or a failed attempt; KeepAlive reconnects unless the ReconnectPolicy gives up
+	StateDisconnected
+	// StateClosed is final, after Close or when the ReconnectPolicy gave up
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateReady:
+		return "ready"
+	case StateDisconnected:
+		return "disconnected"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// stateChange is a ConnState waiting to be passed to OnStateChange
+type stateChange struct {
+	state ConnState
+	err   error
+}
+
+// setState records a change and has it passed to OnStateChange in order. Nothing changes after StateClosed
+func (h *TCPClient) setState(state ConnState, err error) {
+	h.stateMu.Lock()
+	defer h.stateMu.Unlock()
+	if h.state == StateClosed {
+		return
+	}
+	h.state = state
+	if h.OnStateChange == nil {
+		return
+	}
+	h.stateChanges = append(h.stateChanges, stateChange{state, err})
+	if !h.dispatching {
+		h.dispatching = true
+		go h.dispatchStateChanges()
+	}
+}
+
+// dispatchStateChanges calls OnStateChange until no changes are left, in a goroutine of its own, so the callback may call Close
+func (h *TCPClient) dispatchStateChanges() {
+	for {
+		h.stateMu.Lock()
+		if len(h.stateChanges) == 0 {
+			h.dispatching = false
+			h.stateMu.Unlock()
+			return
+		}
+		change := h.stateChanges[0]
+		h.stateChanges = h.stateChanges[1:]
+		h.stateMu.Unlock()
+		h.OnStateChange(change.state, change.err)
+	}
+}
+
+// State is the current state of the connection
+func (h *TCPClient) State() ConnState {
+	h.stateMu.Lock()
+	defer h.stateMu.Unlock()
+	return h.state
+}
@@ -1,12 +1,32 @@
 package rpc
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/namitos/rpc/codec"
+	"github.com/namitos/rpc/packets"
+	"github.com/namitos/rpc/schema"
 )
 
 type testData1 struct {
@@ -32,88 +52,1453 @@ func TestSchema(t *testing.T) {
 	log.Println(string(methodSchemaJSON), err)
 }
 
-// TODO: make real test
-func TestRPC(t *testing.T) {
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	RPCMethods := &Server{Logger: slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelWarn}))}
+	RPCMethods.Set("testError", func() (any, error) {
+		return nil, &OutputError{Code: 123, Message: "errrrrr"}
+	})
+	if _, err := RPCMethods.HandleBytes([]byte(`{"method":"testError"}`), 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	record := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if record[LogKeyMethod] != "testError" || record[LogKeyCode] != float64(123) || record[LogKeyMessageID] != float64(7) {
+		t.Fatal("unexpected record", buf.String())
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Fatal("expected single record", buf.String())
+	}
+}
+
+func TestLogging(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	RPCMethods := &Server{Logging: schema.Enum{LoggingRPCErr}}
+	RPCMethods.Set("testError", func() (any, error) {
+		return nil, &OutputError{Code: 123, Message: "errrrrr"}
+	})
+	if _, err := RPCMethods.HandleBytes([]byte(`{"method":"testError"}`), 7, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "method=testError") || strings.Count(buf.String(), "\n") != 1 {
+		t.Fatal("failed call is not logged", buf.String())
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	RPCMethods := &Server{Metrics: NewMetrics()}
+	RPCMethods.Set("test", func(td testData) testData {
+		return td
+	})
+	if _, err := RPCMethods.HandleBytes([]byte(`[{"method":"test","params":{}},{"method":"missing"}]`), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := RPCMethods.Metrics.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`rpc_server_requests_total{method="test",code="ok"} 1`,
+		`rpc_server_requests_total{method="_unknown",code="-32601"} 1`,
+		`rpc_server_request_duration_seconds_count{method="test"} 1`,
+		`rpc_server_requests_in_flight{method="test"} 0`,
+		`rpc_server_batch_size_bucket{le="2"} 1`,
+		"# TYPE rpc_server_batch_size histogram",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+type testSpan struct {
+	name   string
+	parent TraceContext
+	err    error
+	ended  bool
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	parent, _ := TraceFromContext(ctx)
+	span := &testSpan{name: name, parent: parent}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return ContextWithTrace(ctx, parent.NewChild()), span
+}
+
+func (s *testSpan) SetError(err error) { s.err = err }
+func (s *testSpan) End()               { s.ended = true }
+
+func TestTrace(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, err := ParseTraceparent(traceparent, "congo=t61rcWkgMzE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.Traceparent() != traceparent || !tc.IsSampled() {
+		t.Fatal("traceparent round trip", tc.Traceparent())
+	}
+	if _, err := ParseTraceparent("00-00000000000000000000000000000000-00f067aa0ba902b7-01", ""); err == nil {
+		t.Fatal("zero trace-id accepted")
+	}
+
+	tracer := &testTracer{}
+	RPCMethods := &Server{Tracer: tracer}
+	var handlerTrace TraceContext
+	RPCMethods.Set("test", func(ctx context.Context, td testData) (*testData, error) {
+		handlerTrace, _ = TraceFromContext(ctx)
+		return &td, nil
+	})
+	input, _ := json.Marshal(withTrace([]Input{{Method: "test", Params: testData{}}}, tc))
+	if _, err := RPCMethods.HandleBytes(input, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(tracer.spans) != 1 || !tracer.spans[0].ended || tracer.spans[0].name != "test" || tracer.spans[0].parent.SpanID != tc.SpanID {
+		t.Fatalf("unexpected spans %+v", tracer.spans)
+	}
+	if handlerTrace.TraceID != tc.TraceID || handlerTrace.SpanID == tc.SpanID {
+		t.Fatal("handler context is not a child span", handlerTrace.Traceparent())
+	}
+}
+
+func TestIntrospection(t *testing.T) {
 	RPCMethods := &Server{}
-	RPCMethods.Set("test", func() *testData {
-		now := time.Now().UnixMilli()
-		time.Sleep(time.Second)
-		log.Println("received", now)
-		return &testData{Time: now}
-	})
-	//RPCMethods.Set("test", func(td *testData) *testData {
-	//	log.Println("received", td)
-	//	time.Sleep(time.Second)
-	//	return td
-	//})
-	//RPCMethods.Set("test", func(td testData) testData {
-	//	log.Println("received", td)
-	//	time.Sleep(15 * time.Second)
-	//	return td
-	//})
+	RPCMethods.Set("test", func(td testData) testData {
+		return td
+	})
+	result, err := RPCMethods.HandleBytes([]byte(`[{"method":"system.listMethods"},{"method":"system.methodSchema","params":{"name":"test"}},{"method":"rpc.discover"}]`), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := []struct {
+		Result json.RawMessage
+		Error  *OutputError
+	}{}
+	if err := json.Unmarshal(result, &output); err != nil {
+		t.Fatal(err)
+	}
+	if string(output[0].Result) != `["test"]` {
+		t.Fatal("unexpected methods", string(output[0].Result))
+	}
+	methodSchema := &MethodSchema{}
+	if err := json.Unmarshal(output[1].Result, methodSchema); err != nil || methodSchema.Name != "test" {
+		t.Fatal("unexpected method schema", string(output[1].Result), err)
+	}
+	schemaRoot := &SchemaRoot{}
+	if err := json.Unmarshal(output[2].Result, schemaRoot); err != nil || len(schemaRoot.Methods) != 1 || schemaRoot.OpenRPC == "" {
+		t.Fatal("unexpected schema", string(output[2].Result), err)
+	}
+
+	if output := mustHandle(t, RPCMethods, `{"method":"system.methodSchema","params":{"name":"missing"}}`); output.Error == nil || output.Error.Code != ErrorCodeInvalidParams {
+		t.Fatalf("unexpected output %+v", output)
+	}
 
+	RPCMethods.DisableIntrospection = true
+	if _, err := RPCMethods.Get(MethodDiscover); err == nil {
+		t.Fatal("introspection is not disabled")
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	RPCMethods := &Server{}
+	RPCMethods.Set("fail", func() (bool, error) {
+		return false, errors.New("failed")
+	})
+	if output := mustHandle(t, RPCMethods, `{"method":"fail"}`); output.Error == nil || output.Error.Code != ErrorCodeServer || output.Error.Message != "failed" {
+		t.Fatalf("unexpected output %+v", output)
+	}
+	for _, c := range []struct {
+		err    error
+		status int
+		code   int64
+	}{
+		{errors.New("read failed"), http.StatusInternalServerError, ErrorCodeInternal},
+		{errors.New("not implemented"), http.StatusNotImplemented, ErrorCodeInvalidRequest},
+		{&OutputError{Code: 7, Message: "custom"}, http.StatusInternalServerError, 7},
+	} {
+		w := httptest.NewRecorder()
+		SendAPIError(w, c.err)
+		output := &rawOutput{}
+		if err := json.Unmarshal(w.Body.Bytes(), output); err != nil || w.Code != c.status || output.Error == nil || output.Error.Code != c.code {
+			t.Fatal("unexpected response", c.err, w.Code, w.Body.String(), err)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	RPCMethods := &Server{}
+	var dbErr error
+	RPCMethods.AddHealthCheck("db", func(ctx context.Context) error {
+		return dbErr
+	})
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		RPCMethods.HandleReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Fatal("unexpected status", code)
+	}
+	dbErr = errors.New("db is down")
+	report := &HealthReport{}
+	if err := json.Unmarshal(mustHandle(t, RPCMethods, `{"method":"health.check"}`).Result, report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Ready || report.Checks["db"].Error != "db is down" {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	dbErr = nil
+	if err := RPCMethods.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatal("draining server is ready", code)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	RPCMethods := &Server{}
+	started := make(chan struct{}, 3)
+	RPCMethods.Set("slow", func() bool {
+		started <- struct{}{}
+		time.Sleep(20 * time.Millisecond)
+		return true
+	})
+	serverConn, clientConn := net.Pipe() //responses are only written while the client reads
+	go RPCMethods.ServeConn(serverConn)
+	for i := uint64(1); i <= 3; i++ {
+		if _, err := clientConn.Write(packets.Create([]byte(`{"method":"slow"}`), 0, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	shutdown := make(chan error, 1)
 	go func() {
-		//time.AfterFunc(time.Second*10, func() {
-		//	err := RPCMethods.CloseTCP()
-		//	log.Println("closed", err)
-		//})
-		err := RPCMethods.ListenTCP("8001")
-		if err != nil {
-			log.Println(err)
+		shutdown <- RPCMethods.Shutdown(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond) //calls are done, their responses not written yet
+	for i := 0; i < 3; i++ {
+		if response, _, _, _, err := packets.Parse(clientConn); err != nil || string(response) != `{"result":true}` {
+			t.Fatal("response of a drained call is lost", string(response), err)
 		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type rawOutput struct {
+	Result json.RawMessage
+	Error  *OutputError
+}
+
+func mustHandle(t *testing.T, server *Server, input string) *rawOutput {
+	t.Helper()
+	result, err := server.HandleBytes([]byte(input), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &rawOutput{}
+	if err := json.Unmarshal(result, output); err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestInflight(t *testing.T) {
+	RPCMethods := &Server{AdminMethods: true}
+	started := make(chan struct{})
+	RPCMethods.Set("wait", func(ctx context.Context, td testData) (any, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, context.Cause(ctx)
+	})
+	result := make(chan *rawOutput)
+	go func() {
+		result <- mustHandle(t, RPCMethods, `{"method":"wait","params":{"Time":1}}`)
 	}()
+	<-started
+	calls := []InflightCall{}
+	if err := json.Unmarshal(mustHandle(t, RPCMethods, `{"method":"admin.inflight"}`).Result, &calls); err != nil {
+		t.Fatal(err)
+	}
+	var waitCall *InflightCall
+	for i := range calls {
+		if calls[i].Method == "wait" {
+			waitCall = &calls[i]
+		}
+	}
+	if waitCall == nil || waitCall.Params != `{"Time":1}` {
+		t.Fatalf("wait call is not listed %+v", calls)
+	}
+	w := httptest.NewRecorder()
+	RPCMethods.HandleAdmin(w, httptest.NewRequest("POST", "/admin/inflight?cancel="+strconv.FormatUint(waitCall.ID, 10), nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("cancel failed", w.Body.String())
+	}
+	if output := <-result; output.Error == nil || output.Error.Message != ErrCanceledByAdmin.Error() {
+		t.Fatalf("unexpected output %+v", output)
+	}
+	if len(RPCMethods.Inflight()) != 0 {
+		t.Fatal("finished call is listed")
+	}
+	if output := mustHandle(t, RPCMethods, `{"method":"admin.cancel","params":{"id":999}}`); output.Error == nil || output.Error.Code != ErrorCodeInvalidParams {
+		t.Fatalf("unexpected output %+v", output)
+	}
+}
 
-	time.AfterFunc(time.Millisecond, func() {
-		client := NewTCPClient("127.0.0.1:8001")
-
-		time.AfterFunc(time.Millisecond, func() {
-			wg := &sync.WaitGroup{}
-			wg.Add(5)
-			for i := 0; i < 5; i++ {
-				go func(i int) {
-					defer wg.Done()
-					result := &testData{}
-					t := time.Now().UnixNano()
-					ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-					defer cancel()
-					err := client.Call(ctx, []Input{{
-						Method: "test",
-						Params: map[string]int64{"Time": t},
-					}}, &[]Output{{Result: result}})
-					log.Println(err, t, result.Time, i)
-				}(i)
-			}
-			wg.Wait()
-			log.Println("end")
-		})
+func TestMessageSizeLimit(t *testing.T) {
+	RPCMethods := &Server{MaxFrameSize: 16, MaxBodySize: 16}
+	RPCMethods.Set("test", func(td testData) testData {
+		return td
 	})
+	serverConn, clientConn := net.Pipe()
+	go RPCMethods.ServeConn(serverConn)
+	go clientConn.Write(packets.Create([]byte(`{"method":"test","params":{}}`), 0, 5))
+	response, _, messageID, _, err := packets.Parse(clientConn)
+	if err != nil || messageID != 5 {
+		t.Fatal(err, messageID)
+	}
+	output := &rawOutput{}
+	if err := json.Unmarshal(response, output); err != nil || output.Error == nil || output.Error.Code != ErrorCodeInvalidRequest {
+		t.Fatal("unexpected response", string(response), err)
+	}
+	if _, _, _, _, err := packets.Parse(clientConn); !errors.Is(err, io.EOF) {
+		t.Fatal("connection is not closed", err)
+	}
 
-	select {}
+	w := httptest.NewRecorder()
+	RPCMethods.HandleHTTP(w, httptest.NewRequest("POST", "/api/rpc", strings.NewReader(`{"method":"test","params":{}}`)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatal("unexpected status", w.Code, w.Body.String())
+	}
 }
 
-func TestRPCError(t *testing.T) {
+func TestIdleTimeout(t *testing.T) {
+	RPCMethods := &Server{IdleTimeout: 50 * time.Millisecond, Metrics: NewMetrics()}
+	RPCMethods.Set("sleep", func() bool {
+		time.Sleep(150 * time.Millisecond)
+		return true
+	})
+	serverConn, clientConn := net.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		RPCMethods.ServeConn(serverConn)
+		close(closed)
+	}()
+	go clientConn.Write(packets.Create([]byte(`{"method":"sleep"}`), 0, 1))
+	response, _, _, _, err := packets.Parse(clientConn)
+	if err != nil || string(response) != `{"result":true}` {
+		t.Fatal("busy connection was closed", string(response), err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection is not closed")
+	}
+	buf := &bytes.Buffer{}
+	RPCMethods.Metrics.WriteTo(buf)
+	if !strings.Contains(buf.String(), `rpc_server_tcp_connections_closed_total{reason="idle"} 1`) {
+		t.Fatal("idle close is not counted", buf.String())
+	}
+}
+
+func TestClientIdleTimeout(t *testing.T) {
 	RPCMethods := &Server{}
-	RPCMethods.Set("testError", func() (any, error) {
-		return nil, &OutputError{
-			Code:    123,
-			Message: "errrrrr",
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	states := make(chan ConnState, 100)
+	client := &TCPClient{
+		URL:         listenTest(t, RPCMethods),
+		IdleTimeout: 20 * time.Millisecond,
+		OnStateChange: func(state ConnState, err error) {
+			select {
+			case states <- state:
+			default:
+			}
+		},
+	}
+	connectTest(t, client)
+	expectStates(t, states, StateConnecting, StateReady, StateIdle)
+	select {
+	case state := <-states:
+		t.Fatal("idle client reconnects without calls", state)
+	case <-time.After(100 * time.Millisecond):
+	}
+	result := ""
+	if err := client.CallSingle(context.Background(), "echo", "x", &result); err != nil || result != "x" {
+		t.Fatal("call does not reconnect an idle client", result, err)
+	}
+	expectStates(t, states, StateConnecting, StateReady)
+
+}
+
+// blockingHandler holds the goroutine logging message until release is closed
+type blockingHandler struct {
+	discardHandler
+	message string
+	reached chan struct{}
+	release chan struct{}
+}
+
+func (h *blockingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *blockingHandler) Handle(_ context.Context, r slog.Record) error {
+	if r.Message == h.message {
+		h.reached <- struct{}{}
+		<-h.release
+	}
+	return nil
+}
+
+func TestClientIdleTimeoutCall(t *testing.T) {
+	RPCMethods := &Server{}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	handler := &blockingHandler{message: "TCPClient idle until the next call", reached: make(chan struct{}), release: make(chan struct{})}
+	client := &TCPClient{URL: listenTest(t, RPCMethods), IdleTimeout: 20 * time.Millisecond, Logger: slog.New(handler)}
+	connectTest(t, client)
+	release := sync.OnceFunc(func() { close(handler.release) })
+	t.Cleanup(release)
+	<-handler.reached //KeepAlive is about to wait for a call
+	result := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result <- client.CallSingle(ctx, "echo", "x", nil)
+	}()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		client.stateMu.Lock()
+		woken := false
+		select {
+		case <-client.wake:
+			woken = true
+		default:
+		}
+		client.stateMu.Unlock()
+		if woken {
+			break
 		}
+		if time.Since(start) > time.Second {
+			t.Fatal("call does not wake the client")
+		}
+	}
+	release()
+	if err := <-result; err != nil {
+		t.Fatal("call made during the idle close", client.State(), err)
+	}
+}
+
+func TestIdleTimeoutBlockedWriter(t *testing.T) {
+	RPCMethods := &Server{IdleTimeout: 20 * time.Millisecond}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
 	})
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	closed := make(chan struct{})
 	go func() {
-		err := RPCMethods.ListenTCP("8001")
-		if err != nil {
-			log.Println(err)
+		RPCMethods.ServeConn(serverConn)
+		close(closed)
+	}()
+	clientConn.Write(packets.Create([]byte(`{"method":"echo","params":"x"}`), 0, 1)) //the response is never read
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("idle connection with a blocked writer is not closed")
+	}
+}
+
+func TestFrameWriterQueueFull(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	writer := newFrameWriter(serverConn, 1, 50*time.Millisecond)
+	var err error
+	for i := 0; i < 10 && err == nil; i++ { //nobody reads clientConn: the writer blocks on flush and the queue fills up
+		err = writer.write(outFrame{body: []byte{byte(i)}})
+	}
+	if !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatal("unexpected error", err)
+	}
+	if _, err := io.Copy(io.Discard, clientConn); err != nil {
+		t.Fatal("connection is not closed", err)
+	}
+	if err := writer.write(outFrame{body: []byte{3}}); !errors.Is(err, ErrWriteQueueFull) {
+		t.Fatal("closed writer accepted a frame", err)
+	}
+}
+
+func TestMaxConnCalls(t *testing.T) {
+	RPCMethods := &Server{MaxConnCalls: 8, WriteQueueSize: 1}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	before := runtime.NumGoroutine()
+	serverConn, clientConn := net.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		RPCMethods.ServeConn(serverConn)
+		close(closed)
+	}()
+	go func() { //a peer which never reads its responses
+		for i := uint64(1); i <= 5000; i++ {
+			if _, err := clientConn.Write(packets.Create([]byte(`{"method":"echo","params":"x"}`), 0, i)); err != nil {
+				return
+			}
 		}
 	}()
+	time.Sleep(100 * time.Millisecond)
+	if n := runtime.NumGoroutine() - before; n > 20 {
+		t.Fatal("reading does not stop while calls wait to be written", n)
+	}
+	clientConn.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+func TestTCPClientErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client := &TCPClient{URL: listener.Addr().String()}
+	if err := client.CallSingle(context.Background(), "test", nil, nil); !errors.Is(err, ErrNotConnected) {
+		t.Fatal("unexpected error", err)
+	}
+	go client.KeepAlive()
+	connection, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := client.CallSingle(ctx, "test", nil, nil); !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("unexpected error", err)
+	}
+	packets.Parse(connection)
+
+	go func() {
+		packets.Parse(connection)
+		connection.Close()
+	}()
+	if err := client.CallSingle(context.Background(), "test", nil, nil); !errors.Is(err, ErrDisconnected) {
+		t.Fatal("unexpected error", err)
+	}
+	client.Close()
+}
+
+func TestDial(t *testing.T) {
+	RPCMethods := &Server{}
+	RPCMethods.Set("wait", func(ctx context.Context) bool {
+		<-ctx.Done()
+		return false
+	})
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	URL := listenTest(t, RPCMethods)
+	client, err := Dial(context.Background(), URL, func(client *TCPClient) {
+		client.Handshake = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session := client.conn.Load().session; session.version != packets.Version {
+		t.Fatalf("option is not applied %+v", session)
+	}
+	result := ""
+	if err := client.CallSingle(context.Background(), "echo", "x", &result); err != nil || result != "x" {
+		t.Fatal(result, err)
+	}
+	waiting := make(chan error, 1)
+	go func() {
+		waiting <- client.CallSingle(context.Background(), "wait", nil, nil)
+	}()
+	for start := time.Now(); RPCMethods.health.calls.Load() == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("call is not running")
+		}
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-waiting; !errors.Is(err, ErrClientClosed) {
+		t.Fatal("unexpected error of a waiting call", err)
+	}
+	if err := client.CallSingle(context.Background(), "echo", "x", &result); !errors.Is(err, ErrClientClosed) {
+		t.Fatal("unexpected error after Close", err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal("second Close", err)
+	}
 
-	time.AfterFunc(time.Millisecond, func() {
-		client := NewTCPClient("127.0.0.1:8001")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Dial(ctx, listener.Addr().String()); !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "refused") {
+		t.Fatal("unexpected error", err)
+	}
+}
 
-		time.AfterFunc(time.Millisecond, func() {
-			err := client.CallSingle(context.Background(), "testError", nil, nil)
-			log.Println(err)
+// listenTest serves RPCMethods on an ephemeral port until the test ends
+func listenTest(t *testing.T, RPCMethods *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go RPCMethods.Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestServe(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:0", "[::1]:0"} {
+		RPCMethods := &Server{}
+		RPCMethods.Set("echo", func(s string) string {
+			return s
 		})
+		served := make(chan error, 1)
+		go func() {
+			served <- RPCMethods.ListenTCPAddr(addr)
+		}()
+		var listening net.Addr
+		for start := time.Now(); listening == nil; listening = RPCMethods.Addr() {
+			select {
+			case err := <-served:
+				if addr == "[::1]:0" {
+					t.Skip("no IPv6 loopback", err)
+				}
+				t.Fatal(err)
+			case <-time.After(time.Millisecond):
+			}
+			if time.Since(start) > time.Second {
+				t.Fatal("not listening", addr)
+			}
+		}
+		tcpAddr, ok := listening.(*net.TCPAddr)
+		if !ok || tcpAddr.Port == 0 || tcpAddr.IP.To4() == nil != (addr == "[::1]:0") {
+			t.Fatal("unexpected address", listening)
+		}
+		response, _, _, _, err := packets.Send([]byte(`{"method":"echo","params":"x"}`), 0, 1, listening.String())
+		if err != nil || string(response) != `{"result":"x"}` {
+			t.Fatal(addr, string(response), err)
+		}
+		if err := RPCMethods.CloseTCP(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-served; err != nil {
+			t.Fatal("Serve does not return nil once closed", err)
+		}
+		if RPCMethods.Addr() != nil {
+			t.Fatal("closed listener is reported")
+		}
+	}
+}
+
+// connectTest keeps client connected until the test ends and waits for the first connection
+func connectTest(t *testing.T, client *TCPClient) {
+	go client.KeepAlive()
+	t.Cleanup(func() { client.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	RPCMethods := &Server{RequireHandshake: true}
+	RPCMethods.Set("test", func(td testData) testData {
+		return td
 	})
+	URL := listenTest(t, RPCMethods)
 
-	select {}
+	legacy, err := net.Dial("tcp", URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy.Write(packets.Create([]byte(`{"method":"test"}`), 0, 1))
+	if response, _, _, _, err := packets.Parse(legacy); err == nil {
+		t.Fatal("legacy connection is served", string(response))
+	}
+
+	client := &TCPClient{URL: URL, Handshake: true}
+	connectTest(t, client)
+	if client.conn.Load().session.version != packets.Version || client.conn.Load().session.codec != CodecJSON {
+		t.Fatalf("unexpected session %+v", client.conn.Load().session)
+	}
+	if err := client.Notify(context.Background(), "test", testData{Time: 4}); err != nil {
+		t.Fatal(err)
+	}
+	result := &testData{}
+	if err := client.CallSingle(context.Background(), "test", testData{Time: 5}, result); err != nil || result.Time != 5 {
+		t.Fatal(err, result)
+	}
+}
+
+// pipeStream is one end of a pair of pipes, a stream without deadlines
+type pipeStream struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (s pipeStream) Close() error {
+	s.PipeReader.Close()
+	return s.PipeWriter.Close()
+}
+
+func TestServeConn(t *testing.T) {
+	RPCMethods := &Server{IdleTimeout: time.Millisecond, Metrics: NewMetrics()}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	client := pipeStream{clientReader, clientWriter}
+	closed := make(chan struct{})
+	go func() {
+		RPCMethods.ServeConn(pipeStream{serverReader, serverWriter})
+		close(closed)
+	}()
+	for i := uint64(1); i <= 2; i++ {
+		time.Sleep(5 * time.Millisecond) //longer than IdleTimeout, which needs deadlines
+		response, _, messageID, _, err := packets.SendOn(client, []byte(`{"method":"echo","params":"x"}`), 0, i)
+		if err != nil || messageID != i || string(response) != `{"result":"x"}` {
+			t.Fatal(i, string(response), err)
+		}
+	}
+	client.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection is not closed")
+	}
+	buf := &bytes.Buffer{}
+	RPCMethods.Metrics.WriteTo(buf)
+	if !strings.Contains(buf.String(), `transport="stream"`) {
+		t.Fatal("stream transport is not reported", buf.String())
+	}
+}
+
+func TestCompression(t *testing.T) {
+	RPCMethods := &Server{CompressionThreshold: 1}
+	RPCMethods.Set("echo", func(s []string) []string {
+		return s
+	})
+	params := make([]string, 1000)
+	for i := range params {
+		params[i] = "repetitive"
+	}
+
+	var requestEncoding string
+	recorder := httptest.NewRecorder()
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestEncoding = r.Header.Get("Content-Encoding")
+		RPCMethods.HandleHTTP(recorder, r)
+		for k, v := range recorder.Header() {
+			w.Header()[k] = v
+		}
+		w.Write(recorder.Body.Bytes())
+	}))
+	defer httpServer.Close()
+	httpClient := &HTTPClient{URL: httpServer.URL, Compression: true, CompressionThreshold: 1}
+	result := []string{}
+	if err := httpClient.CallSingle(context.Background(), "echo", params, &result); err != nil || len(result) != len(params) {
+		t.Fatal(err, len(result))
+	}
+	if requestEncoding != CompressionGzip || recorder.Header().Get("Content-Encoding") != CompressionGzip || recorder.Body.Len() > 1000 {
+		t.Fatal("HTTP payloads are not compressed", requestEncoding, recorder.Header(), recorder.Body.Len())
+	}
+
+	body, _ := json.Marshal(params)
+	f := createFrames(&session{compression: CompressionGzip}, body, packets.TypeMessage, 1, 0, 0)[0]
+	frame := packets.Create(f.body, f.messageType, f.messageID)
+	if len(frame) > 1000 {
+		t.Fatal("TCP frame is not compressed", len(frame))
+	}
+	message, messageType, _, _, err := packets.Parse(bytes.NewReader(frame))
+	if err == nil {
+		message, err = readFrameBody(message, messageType, 1<<20)
+	}
+	if err != nil || !bytes.Equal(message, body) {
+		t.Fatal("TCP frame round trip", err)
+	}
+	if _, err := readFrameBody(frame[packets.HeaderLength:], messageType, 100); !errors.Is(err, packets.ErrTooLarge) {
+		t.Fatal("decompression is not limited", err)
+	}
+
+	client := &TCPClient{URL: listenTest(t, RPCMethods), Handshake: true, CompressionThreshold: 1}
+	connectTest(t, client)
+	if client.conn.Load().session.compression != CompressionGzip {
+		t.Fatalf("compression is not negotiated %+v", client.conn.Load().session)
+	}
+	if err := client.CallSingle(context.Background(), "echo", params, &result); err != nil || len(result) != len(params) {
+		t.Fatal(err, len(result))
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	type blob struct {
+		Name string `json:"name"`
+		Data []byte `json:"data"`
+	}
+	RPCMethods := &Server{}
+	RPCMethods.Set("reverse", func(b blob) blob {
+		for i, j := 0, len(b.Data)-1; i < j; i, j = i+1, j-1 {
+			b.Data[i], b.Data[j] = b.Data[j], b.Data[i]
+		}
+		return b
+	})
+	in := blob{Name: "blob", Data: []byte{1, 2, 3}}
+	want := blob{Name: "blob", Data: []byte{3, 2, 1}}
+
+	var contentType string
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		RPCMethods.HandleHTTP(w, r)
+		contentType = w.Header().Get("Content-Type")
+	}))
+	defer httpServer.Close()
+	for _, c := range []codec.Codec{codec.JSON, codec.MessagePack, codec.CBOR} {
+		client := &HTTPClient{URL: httpServer.URL, Codec: c}
+		result := blob{}
+		if err := client.CallSingle(context.Background(), "reverse", in, &result); err != nil || !reflect.DeepEqual(result, want) {
+			t.Fatal(c.Name(), result, err)
+		}
+		if codec.ByContentType(contentType) != c {
+			t.Fatal(c.Name(), "response Content-Type", contentType)
+		}
+		err := client.CallSingle(context.Background(), "missing", in, &result)
+		if outputError, ok := err.(*OutputError); !ok || outputError.Code != ErrorCodeMethodNotFound {
+			t.Fatal(c.Name(), err)
+		}
+	}
+
+	URL := listenTest(t, RPCMethods)
+	for _, c := range []codec.Codec{codec.MessagePack, codec.CBOR} {
+		client := &TCPClient{URL: URL, Handshake: true, Codec: c}
+		connectTest(t, client)
+		if client.conn.Load().session.codec != c.Name() {
+			t.Fatal("codec is not negotiated", client.conn.Load().session.codec)
+		}
+		result := blob{}
+		if err := client.CallSingle(context.Background(), "reverse", in, &result); err != nil || !reflect.DeepEqual(result, want) {
+			t.Fatal(c.Name(), result, err)
+		}
+	}
+}
+
+func TestChunks(t *testing.T) {
+	sess := &session{streaming: true}
+	frames := createFrames(sess, []byte("0123456789"), packets.TypeMessage, 7, 0, 3)
+	if len(frames) != 4 {
+		t.Fatal("frames", len(frames))
+	}
+	parse := func(frame outFrame) ([]byte, uint64) {
+		body, messageType, _, _, err := packets.Parse(bytes.NewReader(packets.Create(frame.body, frame.messageType, frame.messageID)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body, messageType
+	}
+	chunks := newReassembler(100)
+	for i, frame := range frames {
+		body, messageType := parse(frame)
+		message, _, complete, err := chunks.add(body, messageType, 7)
+		if err != nil || complete != (i == len(frames)-1) {
+			t.Fatal(i, complete, err)
+		}
+		if complete && string(message) != "0123456789" {
+			t.Fatal(string(message))
+		}
+	}
+	body, messageType := parse(frames[1])
+	if _, _, _, err := chunks.add(body, messageType, 8); !errors.Is(err, ErrProtocol) {
+		t.Fatal("chunk out of sequence", err)
+	}
+
+	chunks = newReassembler(5)
+	for i, frame := range frames {
+		body, messageType := parse(frame)
+		_, _, complete, err := chunks.add(body, messageType, 7)
+		if complete || (i == 1) != errors.Is(err, packets.ErrTooLarge) {
+			t.Fatal(i, complete, err)
+		}
+	}
+	if len(chunks.pending) != 0 || chunks.size != 0 {
+		t.Fatal("rejected message is kept", chunks.pending, chunks.size)
+	}
+
+	RPCMethods := &Server{MaxFrameSize: 1000, MaxMessageSize: 20000, ChunkSize: 100}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	client := &TCPClient{URL: listenTest(t, RPCMethods), Handshake: true, DisableCompression: true, MaxFrameSize: 1000, MaxMessageSize: 20000, ChunkSize: 300}
+	connectTest(t, client)
+	if !client.conn.Load().session.streaming {
+		t.Fatal("streaming is not negotiated")
+	}
+	large := strings.Repeat("x", 10000)
+	result := ""
+	if err := client.CallSingle(context.Background(), "echo", large, &result); err != nil || result != large {
+		t.Fatal(len(result), err)
+	}
+	err := client.CallSingle(context.Background(), "echo", strings.Repeat("x", 30000), &result)
+	if outputError, ok := err.(*OutputError); !ok || outputError.Code != ErrorCodeInvalidRequest {
+		t.Fatal("message over MaxMessageSize", err)
+	}
+	if err := client.CallSingle(context.Background(), "echo", "small", &result); err != nil || result != "small" {
+		t.Fatal("connection is not usable after a rejected message", result, err)
+	}
+
+	small := &TCPClient{URL: client.URL, Handshake: true, DisableCompression: true, MaxMessageSize: 5000}
+	connectTest(t, small)
+	if err := small.CallSingle(context.Background(), "echo", large, &result); !errors.Is(err, packets.ErrTooLarge) {
+		t.Fatal("response over MaxMessageSize", err)
+	}
+	if err := small.CallSingle(context.Background(), "echo", "small", &result); err != nil || result != "small" {
+		t.Fatal("connection is not usable after a rejected response", result, err)
+	}
+}
+
+func TestStdio(t *testing.T) {
+	RPCMethods := &Server{}
+	notified := make(chan string, 1)
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	RPCMethods.Set("notify", func(s string) bool {
+		notified <- s
+		return true
+	})
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- RPCMethods.ServeStream(serverReader, serverWriter)
+	}()
+	client := NewStdioClient(clientReader, clientWriter)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(s string) {
+			defer wg.Done()
+			result := ""
+			if err := client.CallSingle(context.Background(), "echo", s, &result); err != nil || result != s {
+				t.Error(s, result, err)
+			}
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	a, b := "", ""
+	output := []Output{{Result: &a}, {Result: &b}}
+	if err := client.Call(context.Background(), []Input{{ID: "a", Method: "echo", Params: "1"}, {ID: "a", Method: "echo", Params: "2"}}, &output); err != nil {
+		t.Fatal(err)
+	}
+	if a != "1" || b != "2" || output[0].ID != "a" || output[1].ID != "a" {
+		t.Fatalf("unexpected batch output %+v %v %v", output, a, b)
+	}
+
+	if err := client.Notify(context.Background(), "notify", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-notified; s != "x" {
+		t.Fatal("unexpected notification", s)
+	}
+	result := ""
+	if err := client.CallSingle(context.Background(), "echo", "after", &result); err != nil || result != "after" {
+		t.Fatal("notification is answered", result, err)
+	}
+
+	client.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	serverWriter.Close()
+	<-client.done
+	if err := client.CallSingle(context.Background(), "echo", "", nil); !errors.Is(err, ErrDisconnected) {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+func TestStdioErrorWithoutID(t *testing.T) {
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+	go func() { //a server which cannot parse anything
+		reader := bufio.NewReader(serverReader)
+		for {
+			if _, err := packets.ReadContentLength(reader, 0); err != nil {
+				return
+			}
+			serverWriter.Write(packets.CreateContentLength([]byte(`{"error":{"code":-32700,"message":"parse error"}}`)))
+		}
+	}()
+	client := NewStdioClient(clientReader, clientWriter)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := client.CallSingle(ctx, "echo", "x", nil)
+	outputError := &OutputError{}
+	if !errors.As(err, &outputError) || outputError.Code != ErrorCodeParse {
+		t.Fatal("unexpected error", err)
+	}
+}
+
+// TestStdioProcess is the server started by TestCommandClient
+func TestStdioProcess(t *testing.T) {
+	if os.Getenv("RPC_TEST_STDIO") == "" {
+		t.Skip("started by TestCommandClient")
+	}
+	RPCMethods := &Server{}
+	RPCMethods.Set("pid", func() int {
+		return os.Getpid()
+	})
+	if err := RPCMethods.ServeStdio(); err != nil {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestCommandClient(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestStdioProcess$")
+	cmd.Env = append(os.Environ(), "RPC_TEST_STDIO=1")
+	client, err := NewCommandClient(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := 0
+	if err := client.CallSingle(context.Background(), "pid", nil, &pid); err != nil || pid != cmd.Process.Pid {
+		t.Fatal(pid, err)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal("process did not exit cleanly", err)
+	}
+}
+
+func TestLocalClient(t *testing.T) {
+	RPCMethods := &Server{}
+	RPCMethods.Set("touch", func(td *testData) *testData {
+		td.Time++
+		return td
+	})
+	RPCMethods.Set("sleep", func(ctx context.Context) bool {
+		<-ctx.Done()
+		return false
+	})
+	finished := make(chan struct{}, 2)
+	RPCMethods.Set("slow", func() *testData {
+		defer func() { finished <- struct{}{} }()
+		time.Sleep(20 * time.Millisecond)
+		return &testData{Time: 9}
+	})
+	middlewareCalls := atomic.Int64{}
+	client := NewLocalClient(RPCMethods)
+	client.Middleware = func(params reflect.Value) {
+		middlewareCalls.Add(1)
+	}
+
+	params := &testData{Time: 1}
+	result := &testData{}
+	if err := client.CallSingle(context.Background(), "touch", params, result); err != nil || result.Time != 2 || params.Time != 1 {
+		t.Fatal("serialized call", params, result, err)
+	}
+	if err := client.CallSingle(context.Background(), "missing", nil, nil); err == nil || err.(*OutputError).Code != ErrorCodeMethodNotFound {
+		t.Fatal("unexpected error", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.CallSingle(ctx, "sleep", nil, nil); !errors.Is(err, ErrTimeout) {
+		t.Fatal("unexpected error", err)
+	}
+
+	client.ZeroCopy = true
+	result = &testData{}
+	if err := client.CallSingle(context.Background(), "touch", params, result); err != nil || result.Time != 2 || params.Time != 2 {
+		t.Fatal("zero-copy call", params, result, err)
+	}
+	var shared any
+	output := []Output{{Result: &shared}, {}}
+	if err := client.Call(context.Background(), []Input{{Method: "touch", Params: *params}, {ID: "b", Method: "touch", Params: "x"}}, &output); err != nil {
+		t.Fatal(err)
+	}
+	if td, ok := shared.(*testData); !ok || td.Time != 3 || params.Time != 2 {
+		t.Fatalf("unexpected result %#v", shared)
+	}
+	if output[1].ID != "b" || output[1].Error == nil || output[1].Error.Code != ErrorCodeInvalidParams {
+		t.Fatalf("unexpected output %+v", output[1])
+	}
+	if middlewareCalls.Load() != 3 {
+		t.Fatal("middleware is not called", middlewareCalls.Load())
+	}
+
+	for _, zeroCopy := range []bool{false, true} {
+		client.ZeroCopy = zeroCopy
+		result = &testData{}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		if err := client.CallSingle(ctx, "slow", nil, result); !errors.Is(err, ErrTimeout) {
+			t.Fatal("unexpected error", err)
+		}
+		cancel()
+		result.Time = 1 //owned by the caller again
+		<-finished
+		time.Sleep(time.Millisecond)
+		if result.Time != 1 {
+			t.Fatal("result of a timed out call is written", zeroCopy, result)
+		}
+	}
+}
+
+func TestTCPPool(t *testing.T) {
+	RPCMethods := &Server{}
+	release := make(chan struct{})
+	RPCMethods.Set("wait", func() bool {
+		<-release
+		return true
+	})
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	pool := &TCPPool{URL: listenTest(t, RPCMethods), Size: 3, Configure: func(client *TCPClient) {
+		client.Handshake = true
+		client.ReconnectInterval = 10 * time.Millisecond
+	}}
+	pool.Start()
+	t.Cleanup(func() { pool.Close() })
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		connected := 0
+		for _, c := range pool.clients {
+			if c.client.conn.Load() != nil {
+				connected++
+			}
+		}
+		if connected == 3 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("pool is not connected", connected)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := pool.CallSingle(context.Background(), "wait", nil, nil); err != nil {
+				t.Error(err)
+			}
+		}()
+		for start := time.Now(); RPCMethods.health.calls.Load() != int64(i+1); time.Sleep(time.Millisecond) {
+			if time.Since(start) > time.Second {
+				t.Fatal("call is not running", i)
+			}
+		}
+	}
+	for i, c := range pool.clients {
+		if c.inFlight.Load() != 1 {
+			t.Fatal("calls are not spread over the connections", i, c.inFlight.Load())
+		}
+	}
+	result := ""
+	if err := pool.CallSingle(context.Background(), "echo", "x", &result); err != nil || result != "x" {
+		t.Fatal("call behind busy connections", result, err)
+	}
+	close(release)
+	wg.Wait()
+
+	RPCMethods.closeConnections()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		err := pool.CallSingle(context.Background(), "echo", "y", &result)
+		if err == nil && result == "y" {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("broken connections are not replaced", err)
+		}
+	}
+}
+
+func TestReconnectPolicy(t *testing.T) {
+	policy := &ReconnectPolicy{InitialInterval: 10 * time.Millisecond, MaxInterval: 50 * time.Millisecond}
+	for i, expected := range []time.Duration{10, 20, 40, 50, 50} {
+		if d := policy.delay(i + 1); d != expected*time.Millisecond {
+			t.Fatal("unexpected delay", i+1, d)
+		}
+	}
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := policy.delay(2); d < 10*time.Millisecond || d > 30*time.Millisecond {
+			t.Fatal("delay out of jitter range", d)
+		}
+	}
+
+	states := make(chan ConnState, 100)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close()
+	client := &TCPClient{
+		URL:       listener.Addr().String(),
+		Reconnect: &ReconnectPolicy{InitialInterval: time.Millisecond, MaxAttempts: 3},
+		OnStateChange: func(state ConnState, err error) {
+			states <- state
+		},
+	}
+	go client.KeepAlive()
+	if err := client.WaitReady(context.Background()); !errors.Is(err, ErrClientClosed) || !strings.Contains(err.Error(), "refused") {
+		t.Fatal("unexpected error", err)
+	}
+	expectStates(t, states, StateConnecting, StateDisconnected, StateConnecting, StateDisconnected, StateConnecting, StateDisconnected, StateClosed)
+	if client.State() != StateClosed {
+		t.Fatal("unexpected state", client.State())
+	}
+
+	RPCMethods := &Server{}
+	client, err = Dial(context.Background(), listenTest(t, RPCMethods), func(client *TCPClient) {
+		client.Reconnect = &ReconnectPolicy{InitialInterval: time.Millisecond, MaxAttempts: 1}
+		client.OnStateChange = func(state ConnState, err error) {
+			states <- state
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectStates(t, states, StateConnecting, StateReady)
+	roundTripTest(t, client)
+	RPCMethods.closeConnections()
+	expectStates(t, states, StateDisconnected, StateConnecting, StateReady)
+	if err := client.WaitReady(context.Background()); err != nil || client.State() != StateReady {
+		t.Fatal("not ready after reconnecting", client.State(), err)
+	}
+	client.Close()
+	expectStates(t, states, StateClosed)
+}
+
+// roundTripTest calls the server, which is then serving the connection of client and tracks it
+func roundTripTest(t *testing.T, client *TCPClient) {
+	t.Helper()
+	if err := client.CallSingle(context.Background(), MethodHealthCheck, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectStates(t *testing.T, states chan ConnState, expected ...ConnState) {
+	t.Helper()
+	for i, state := range expected {
+		select {
+		case s := <-states:
+			if s != state {
+				t.Fatalf("state %v is %v, expected %v", i, s, state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no state %v, expected %v", i, state)
+		}
+	}
+}
+
+func TestReconnectQueue(t *testing.T) {
+	RPCMethods := &Server{}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	URL := listenTest(t, RPCMethods)
+	client, err := Dial(context.Background(), URL, func(client *TCPClient) {
+		client.ReconnectQueueSize = 2
+		client.Reconnect = &ReconnectPolicy{InitialInterval: time.Millisecond, MaxInterval: 5 * time.Millisecond}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	roundTripTest(t, client)
+	RPCMethods.CloseTCP()
+	RPCMethods.closeConnections()
+	for start := time.Now(); client.conn.Load() != nil; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("connection is not lost")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := client.CallSingle(ctx, "echo", "x", nil); !errors.Is(err, ErrTimeout) {
+		t.Fatal("queued call does not time out", err)
+	}
+	results := make(chan error, 2)
+	for _, s := range []string{"a", "b"} {
+		go func(s string) {
+			result := ""
+			err := client.CallSingle(context.Background(), "echo", s, &result)
+			if err == nil && result != s {
+				err = fmt.Errorf("unexpected result %v", result)
+			}
+			results <- err
+		}(s)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		client.stateMu.Lock()
+		queued := client.queued
+		client.stateMu.Unlock()
+		if queued == 2 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("calls are not queued", queued)
+		}
+	}
+	if err := client.CallSingle(context.Background(), "echo", "c", nil); !errors.Is(err, ErrNotConnected) {
+		t.Fatal("call over ReconnectQueueSize is queued", err)
+	}
+
+	go RPCMethods.ListenTCPAddr(URL)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued calls are not sent after reconnecting")
+		}
+	}
+	RPCMethods.CloseTCP()
+}
+
+func TestHeartbeat(t *testing.T) {
+	RPCMethods := &Server{HeartbeatInterval: 10 * time.Millisecond, Metrics: NewMetrics()}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	URL := listenTest(t, RPCMethods)
+
+	client := &TCPClient{URL: URL, Handshake: true, HeartbeatInterval: 10 * time.Millisecond}
+	connectTest(t, client)
+	if !client.conn.Load().session.heartbeat {
+		t.Fatalf("heartbeat is not negotiated %+v", client.conn.Load().session)
+	}
+	time.Sleep(100 * time.Millisecond)
+	result := ""
+	if err := client.CallSingle(context.Background(), "echo", "x", &result); err != nil || result != "x" || client.State() != StateReady {
+		t.Fatal("answered heartbeats closed the connection", client.State(), result, err)
+	}
+
+	peer, err := net.Dial("tcp", URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	hello, _ := packets.CreateHello(packets.Version, localHello(DefaultMaxMessageSize, false, nil))
+	peer.Write(hello)
+	if _, serverHello, err := packets.ReadHello(peer, DefaultMaxMessageSize); err != nil || !serverHello.Heartbeat {
+		t.Fatal("unexpected server hello", serverHello, err)
+	}
+	packets.Write(peer, nil, packets.TypePing, 7)
+	pings := 0
+	for {
+		_, messageType, messageID, _, err := packets.Parse(peer)
+		if err != nil {
+			break
+		}
+		switch messageType {
+		case packets.TypePong:
+			if messageID != 7 {
+				t.Fatal("pong does not echo the ping", messageID)
+			}
+		case packets.TypePing:
+			pings++
+		default:
+			t.Fatal("unexpected frame", messageType)
+		}
+	}
+	if pings == 0 {
+		t.Fatal("server does not ping")
+	}
+	buf := &bytes.Buffer{}
+	RPCMethods.Metrics.WriteTo(buf)
+	if !strings.Contains(buf.String(), `rpc_server_tcp_connections_closed_total{reason="heartbeat"} 1`) {
+		t.Fatal("silent peer is not closed by the heartbeat", buf.String())
+	}
+}
+
+func TestHeartbeatIdleTimeout(t *testing.T) {
+	RPCMethods := &Server{IdleTimeout: 50 * time.Millisecond, HeartbeatInterval: 10 * time.Millisecond, Metrics: NewMetrics()}
+	client := &TCPClient{URL: listenTest(t, RPCMethods), Handshake: true, HeartbeatInterval: 10 * time.Millisecond}
+	connectTest(t, client)
+	buf := &bytes.Buffer{}
+	for start := time.Now(); !strings.Contains(buf.String(), `rpc_server_tcp_connections_closed_total{reason="idle"} 1`); time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("heartbeats keep an idle connection open", buf.String())
+		}
+		buf.Reset()
+		RPCMethods.Metrics.WriteTo(buf)
+	}
+}
+
+func TestHeartbeatReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() { //a server which completes the handshake, then stops answering
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, _, err := packets.ReadHello(conn, DefaultMaxMessageSize); err != nil {
+				return
+			}
+			hello, _ := packets.CreateHello(packets.Version, localHello(DefaultMaxMessageSize, false, nil))
+			conn.Write(hello)
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+	errs := make(chan error, 100)
+	states := make(chan ConnState, 100)
+	client := &TCPClient{
+		URL:               listener.Addr().String(),
+		Handshake:         true,
+		HeartbeatInterval: 10 * time.Millisecond,
+		ReconnectInterval: time.Millisecond,
+		OnStateChange: func(state ConnState, err error) {
+			if state == StateDisconnected {
+				errs <- err
+			}
+			states <- state
+		},
+	}
+	connectTest(t, client)
+	expectStates(t, states, StateConnecting, StateReady, StateDisconnected, StateConnecting, StateReady)
+	if err := <-errs; !errors.Is(err, ErrHeartbeatTimeout) {
+		t.Fatal("unexpected error", err)
+	}
 }
@@ -0,0 +1,222 @@
+// Package rpctest runs an rpc.Server on ephemeral ports for the duration of a test and returns clients calling it
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/namitos/rpc"
+	"github.com/namitos/rpc/packets"
+)
+
+// ConnectTimeout limits waiting for the TCP client of NewServer to connect
+var ConnectTimeout = 5 * time.Second
+
+// Server is an rpc.Server listening on TCP and HTTP on the loopback interface until the test ends
+type Server struct {
+	*rpc.Server
+	// TCPAddr is the host:port of the TCP listener, HTTPURL the URL of HandleHTTP
+	TCPAddr string
+	HTTPURL string
+	// TCP and HTTP are clients calling the server; TCP is connected with the handshake
+	TCP  *rpc.TCPClient
+	HTTP *rpc.HTTPClient
+
+	listener   net.Listener
+	httpServer *httptest.Server
+	transport  *http.Transport
+	conns      map[*faultConn]struct{}
+	connsMu    sync.Mutex
+	drops      atomic.Int64
+	delay      atomic.Int64
+}
+
+// NewServer serves srv on ephemeral ports and connects the clients; everything is closed by t.Cleanup
+func NewServer(t testing.TB, srv *rpc.Server) *Server {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Server:    srv,
+		TCPAddr:   listener.Addr().String(),
+		listener:  listener,
+		transport: &http.Transport{},
+		conns:     map[*faultConn]struct{}{},
+	}
+	go s.accept()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/rpc", s.handleHTTP)
+	s.httpServer = httptest.NewServer(mux)
+	s.HTTPURL = s.httpServer.URL + "/api/rpc"
+	t.Cleanup(s.close)
+
+	s.HTTP = &rpc.HTTPClient{URL: s.HTTPURL, Transport: s.transport}
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectTimeout)
+	defer cancel()
+	s.TCP, err = rpc.Dial(ctx, s.TCPAddr, func(client *rpc.TCPClient) {
+		client.Handshake = true
+		client.ReconnectInterval = 10 * time.Millisecond
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// WaitConnected waits until client has a working connection; calls fail with rpc.ErrNotConnected
+// or rpc.ErrDisconnected before that
+func WaitConnected(client *rpc.TCPClient, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := client.Call(ctx, []rpc.Input{}, &[]rpc.Output{}) //answered without running anything
+		cancel()
+		if !errors.Is(err, rpc.ErrNotConnected) && !errors.Is(err, rpc.ErrDisconnected) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *Server) accept() {
+	for {
+		connection, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		conn := &faultConn{Conn: connection, server: s}
+		s.connsMu.Lock()
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+		go func() {
+			s.Server.ServeConn(conn)
+			s.connsMu.Lock()
+			delete(s.conns, conn)
+			s.connsMu.Unlock()
+		}()
+	}
+}
+
+func (s *Server) close() {
+	if s.TCP != nil {
+		s.TCP.Close()
+	}
+	s.listener.Close()
+	s.DropConnections()
+	s.httpServer.Close()
+	s.transport.CloseIdleConnections()
+}
+
+// DropConnections closes the server side of every open TCP connection
+func (s *Server) DropConnections() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// DropResponses makes the server drop the connection of the next n responses instead of sending them,
+// so those calls are lost mid-call after the method ran. On TCP all calls of the connection are lost with it
+func (s *Server) DropResponses(n int) {
+	s.drops.Store(int64(n))
+}
+
+// DelayResponses holds every response back for d before sending it; 0 sends them right away again
+func (s *Server) DelayResponses(d time.Duration) {
+	s.delay.Store(int64(d))
+}
+
+// fault applies the injected faults to a response about to be sent and reports whether it should be dropped
+func (s *Server) fault() bool {
+	if d := time.Duration(s.delay.Load()); d > 0 {
+		time.Sleep(d)
+	}
+	for {
+		n := s.drops.Load()
+		if n <= 0 {
+			return false
+		}
+		if s.drops.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.fault() {
+		s.Server.HandleHTTP(w, r)
+		return
+	}
+	s.Server.HandleHTTP(httptest.NewRecorder(), r)
+	if hijacker, ok := w.(http.Hijacker); ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// faultConn is a server side TCP connection which applies injected faults to the responses written to it
+type faultConn struct {
+	net.Conn
+	server  *Server
+	written atomic.Bool
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if !c.written.Swap(true) && len(b) >= packets.PreambleLength {
+		if _, err := packets.ParsePreamble(b[:packets.PreambleLength]); err == nil { //the handshake is not a response
+			return c.Conn.Write(b)
+		}
+	}
+	if c.server.fault() {
+		c.Conn.Close()
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+// ErrorCode returns the code of the rpc.OutputError in the chain of err
+func ErrorCode(err error) (int64, bool) {
+	outputError := &rpc.OutputError{}
+	if !errors.As(err, &outputError) {
+		return 0, false
+	}
+	return outputError.Code, true
+}
+
+// AssertResult calls method and fails the test unless it returns a result deeply equal to expected
+func AssertResult(t testing.TB, client rpc.Client, method string, params any, expected any) {
+	t.Helper()
+	result := reflect.New(reflect.TypeOf(expected))
+	if err := client.CallSingle(context.Background(), method, params, result.Interface()); err != nil {
+		t.Fatalf("%v: %v", method, err)
+	}
+	if !reflect.DeepEqual(result.Elem().Interface(), expected) {
+		t.Fatalf("%v: got %#v, expected %#v", method, result.Elem().Interface(), expected)
+	}
+}
+
+// AssertErrorCode calls method and fails the test unless it returns an rpc.OutputError with code, which it returns
+func AssertErrorCode(t testing.TB, client rpc.Client, method string, params any, code int64) *rpc.OutputError {
+	t.Helper()
+	err := client.CallSingle(context.Background(), method, params, nil)
+	outputError := &rpc.OutputError{}
+	if !errors.As(err, &outputError) || outputError.Code != code {
+		t.Fatalf("%v: got error %v, expected code %v", method, err, code)
+	}
+	return outputError
+}
@@ -0,0 +1,99 @@
+package rpctest
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/namitos/rpc"
+)
+
+type testData struct {
+	Time int64
+}
+
+func TestRPC(t *testing.T) {
+	RPCMethods := &rpc.Server{}
+	RPCMethods.Set("test", func(td *testData) *testData {
+		time.Sleep(10 * time.Millisecond)
+		return td
+	})
+	s := NewServer(t, RPCMethods)
+	for _, client := range []rpc.Client{s.TCP, s.HTTP} {
+		wg := sync.WaitGroup{}
+		for i := int64(0); i < 5; i++ {
+			wg.Add(1)
+			go func(i int64) {
+				defer wg.Done()
+				result := &testData{}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				err := client.Call(ctx, []rpc.Input{{Method: "test", Params: map[string]int64{"Time": i}}}, &[]rpc.Output{{Result: result}})
+				if err != nil || result.Time != i {
+					t.Error(i, result, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		AssertResult(t, client, "test", testData{Time: 7}, &testData{Time: 7})
+	}
+}
+
+func TestRPCError(t *testing.T) {
+	RPCMethods := &rpc.Server{}
+	RPCMethods.Set("testError", func() (any, error) {
+		return nil, &rpc.OutputError{
+			Code:    123,
+			Message: "errrrrr",
+		}
+	})
+	s := NewServer(t, RPCMethods)
+	for _, client := range []rpc.Client{s.TCP, s.HTTP} {
+		if outputError := AssertErrorCode(t, client, "testError", nil, 123); outputError.Message != "errrrrr" {
+			t.Fatal("unexpected message", outputError.Message)
+		}
+		AssertErrorCode(t, client, "missing", nil, rpc.ErrorCodeMethodNotFound)
+	}
+	if code, ok := ErrorCode(rpc.ErrTimeout); ok {
+		t.Fatal("code of an error which is not an OutputError", code)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	RPCMethods := &rpc.Server{}
+	RPCMethods.Set("echo", func(s string) string {
+		return s
+	})
+	s := NewServer(t, RPCMethods)
+
+	s.DropResponses(1)
+	if err := s.TCP.CallSingle(context.Background(), "echo", "x", nil); !errors.Is(err, rpc.ErrDisconnected) {
+		t.Fatal("unexpected error", err)
+	}
+	if err := WaitConnected(s.TCP, time.Second); err != nil {
+		t.Fatal("client does not reconnect", err)
+	}
+	AssertResult(t, s.TCP, "echo", "y", "y")
+
+	s.DropResponses(1)
+	if err := s.HTTP.CallSingle(context.Background(), "echo", "x", nil); err == nil {
+		t.Fatal("dropped HTTP response is received")
+	}
+	AssertResult(t, s.HTTP, "echo", "y", "y")
+
+	s.DelayResponses(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.TCP.CallSingle(ctx, "echo", "x", nil); !errors.Is(err, rpc.ErrTimeout) {
+		t.Fatal("unexpected error", err)
+	}
+	s.DelayResponses(0)
+
+	s.DropConnections()
+	if err := WaitConnected(s.TCP, time.Second); err != nil {
+		t.Fatal("client does not reconnect", err)
+	}
+	AssertResult(t, s.TCP, "echo", "z", "z")
+}
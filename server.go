@@ -1,15 +1,22 @@
 package rpc
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/namitos/rpc/codec"
 	"github.com/namitos/rpc/packets"
 	"github.com/namitos/rpc/schema"
 )
@@ -18,27 +25,122 @@ type Server struct {
 	sync.Map
 	AllowOrigins   []string
 	AllowOriginsFn func(host string) bool
-	Logging        schema.Enum
+	// Logger receives structured records: transport failures at Error level, failed calls at Warn, traffic at Debug.
+	// Nothing is logged when nil
+	Logger *slog.Logger
+	// Deprecated: use Logger. Without a Logger, Logging writes the selected records to the standard log package:
+	// LoggingBase traffic, LoggingRPCErr failed calls, LoggingErr failed calls and transport failures
+	Logging schema.Enum
+	// Metrics collects call, traffic and connection statistics when set; ListenHTTP then serves them on /metrics
+	Metrics *Metrics
+	// HealthRoutes makes ListenHTTP serve HandleHealthz and HandleReadyz on /healthz and /readyz
+	HealthRoutes bool
+	// Tracer starts a span around every call when set
+	Tracer Tracer
+	// DisableIntrospection turns off the built-in rpc.discover, system.listMethods and system.methodSchema methods
+	DisableIntrospection bool
+	// MaxFrameSize limits TCP messages and MaxBodySize HTTP request bodies, both DefaultMaxMessageSize when 0.
+	// Oversized input is answered with an ErrorCodeInvalidRequest error and its connection is closed
+	MaxFrameSize uint64
+	MaxBodySize  int64
+	// MaxMessageSize limits a TCP message reassembled from chunks, and all incomplete ones of a connection together,
+	// MaxFrameSize when 0. A message passing it is answered with an ErrorCodeInvalidRequest error and its remaining chunks are dropped
+	MaxMessageSize uint64
+	// ChunkSize splits responses into chunks of that many bytes, DefaultChunkSize when 0, on connections which negotiated
+	// streaming in the handshake, so a huge response does not hold back others on the connection
+	ChunkSize int
+	// ReadTimeout limits reading a TCP frame once it started arriving, WriteTimeout limits writing one.
+	// IdleTimeout closes TCP connections without running calls and incoming messages for that long. Heartbeat pings and pongs
+	// are not messages, so a connection is closed even while its peer keeps sending them. 0 disables a timeout
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// WriteQueueSize is the number of response frames queued per TCP connection, DefaultWriteQueueSize when 0.
+	// Responses wait for space in a full queue; the connection is closed when none frees up within WriteTimeout,
+	// DefaultQueueFullTimeout when 0
+	WriteQueueSize int
+	// MaxConnCalls limits the calls of a TCP connection running or waiting for their response to be queued,
+	// DefaultMaxConnCalls when 0. The connection is not read while that many are, so a peer not reading its responses stalls
+	MaxConnCalls int
+	// RequireHandshake closes TCP connections which do not open with the versioned handshake instead of serving them as legacy ones
+	RequireHandshake bool
+	// DisableCompression refuses compression in the handshake and for HTTP. Payloads from CompressionThreshold bytes,
+	// DefaultCompressionThreshold when 0, are gzip compressed when the peer accepts it
+	DisableCompression   bool
+	CompressionThreshold int
+	// AdminMethods enables admin.inflight and admin.cancel for every client of the server, so only set it on servers
+	// reachable by trusted clients. HandleAdmin serves the same over HTTP wherever the caller mounts it, behind its own auth
+	AdminMethods bool
+	// HeartbeatInterval pings TCP clients which support it that often; a connection with nothing from its client for
+	// HeartbeatMisses intervals, DefaultHeartbeatMisses when 0, is closed. Pings of clients are answered either way.
+	// Heartbeats detect dead peers only; they do not keep an unused connection open past IdleTimeout
+	HeartbeatInterval time.Duration
+	HeartbeatMisses   int
 
 	schemaRoot *SchemaRoot
+	legacyLog  legacyLogger
 	listener   net.Listener
-	closed     bool
+	listenerMu sync.Mutex
+	connIDs    uint64
+
+	builtins     map[string]*builtinMethod
+	builtinsOnce sync.Once
+	health       healthState
+	inflight     inflightState
 }
 
-const (
-	LoggingErr    = "err"
-	LoggingRPCErr = "RPCErr"
-	LoggingBase   = "base"
-)
+// DefaultMaxMessageSize is the size limit of a TCP frame or HTTP body unless configured otherwise
+const DefaultMaxMessageSize = 64 << 20
+
+// DefaultMaxConnCalls is the number of concurrent calls of a TCP connection unless configured otherwise
+const DefaultMaxConnCalls = 1024
+
+func (h *Server) maxFrameSize() uint64 {
+	if h.MaxFrameSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return h.MaxFrameSize
+}
+
+func (h *Server) maxMessageSize() uint64 {
+	if h.MaxMessageSize == 0 {
+		return h.maxFrameSize()
+	}
+	return h.MaxMessageSize
+}
+
+func (h *Server) maxConnCalls() int {
+	if h.MaxConnCalls <= 0 {
+		return DefaultMaxConnCalls
+	}
+	return h.MaxConnCalls
+}
+
+func (h *Server) maxBodySize() int64 {
+	if h.MaxBodySize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return h.MaxBodySize
+}
+
+func (h *Server) logger() *slog.Logger {
+	if h.Logger == nil && len(h.Logging) > 0 {
+		return h.legacyLog.get(h.Logging)
+	}
+	return loggerOrDiscard(h.Logger)
+}
+
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 type methodHandler struct {
 	fn           any
+	withContext  bool //fn accepts context.Context as the first argument
 	inputType    reflect.Type
 	resultType   reflect.Type
 	methodSchema *MethodSchema
 }
 
-func (h *methodHandler) unmarshalInput(inputMessage json.RawMessage) (reflect.Value, error) {
+func (h *methodHandler) unmarshalInput(c codec.Codec, inputMessage codec.RawMessage) (reflect.Value, error) {
 	var input reflect.Value
 	var inputPtr reflect.Value
 	if h.inputType.Kind() == reflect.Ptr {
@@ -51,13 +153,39 @@ func (h *methodHandler) unmarshalInput(inputMessage json.RawMessage) (reflect.Va
 	if inputMessage == nil {
 		return input, nil
 	}
-	if err := json.Unmarshal(inputMessage, inputPtr.Interface()); err != nil {
+	if err := c.Unmarshal(inputMessage, inputPtr.Interface()); err != nil {
 		return input, err
 	}
 	return input, nil
 }
 
+// valueInput is unmarshalInput for params passed as they are; they must be assignable to the input type or point to a value which is
+func (h *methodHandler) valueInput(value any) (reflect.Value, error) {
+	if value == nil {
+		return h.unmarshalInput(nil, nil)
+	}
+	v := reflect.ValueOf(value)
+	switch {
+	case v.Type().AssignableTo(h.inputType):
+		return v, nil
+	case v.Kind() == reflect.Ptr && !v.IsNil() && v.Elem().Type().AssignableTo(h.inputType):
+		return v.Elem(), nil
+	case h.inputType.Kind() == reflect.Ptr && v.Type().AssignableTo(h.inputType.Elem()):
+		input := reflect.New(h.inputType.Elem())
+		input.Elem().Set(v)
+		return input, nil
+	}
+	return reflect.Value{}, fmt.Errorf("params of type %v, %v expected", v.Type(), h.inputType)
+}
+
 func (h *Server) Set(name string, fn any, methodSchemas ...MethodSchema) {
+	schemaRoot := h.getSchemaRoot()
+	method := newMethodHandler(name, fn, schemaRoot.Defs, methodSchemas...)
+	h.Store(name, method)
+	schemaRoot.Methods = append(schemaRoot.Methods, method.methodSchema)
+}
+
+func (h *Server) getSchemaRoot() *SchemaRoot {
 	if h.schemaRoot == nil {
 		h.schemaRoot = &SchemaRoot{
 			Info: SchemaRootInfo{
@@ -67,22 +195,30 @@ func (h *Server) Set(name string, fn any, methodSchemas ...MethodSchema) {
 			Defs:    schema.Map{},
 		}
 	}
+	return h.schemaRoot
+}
 
+func newMethodHandler(name string, fn any, defs schema.Map, methodSchemas ...MethodSchema) *methodHandler {
 	fnType := reflect.ValueOf(fn).Type()
 	if fnType.Kind() != reflect.Func {
 		log.Fatalf("%v should be a Func type", name)
 	}
 	var inputType reflect.Type
 	params := []MethodSchemaParam{}
-	if fnType.NumIn() > 0 {
-		inputType = fnType.In(0)
+	withContext := fnType.NumIn() > 0 && fnType.In(0) == contextType
+	inputIndex := 0
+	if withContext {
+		inputIndex = 1
+	}
+	if fnType.NumIn() > inputIndex {
+		inputType = fnType.In(inputIndex)
 		inputTypeForSchema := inputType
 		if inputType.Kind() == reflect.Ptr {
 			inputTypeForSchema = inputType.Elem()
 		}
 		params = append(params, MethodSchemaParam{
 			Name:     "Params",
-			Schema:   schema.Get(inputTypeForSchema, h.schemaRoot.Defs),
+			Schema:   schema.Get(inputTypeForSchema, defs),
 			Required: true,
 		})
 	}
@@ -100,28 +236,30 @@ func (h *Server) Set(name string, fn any, methodSchemas ...MethodSchema) {
 		methodSchema = &MethodSchema{
 			Name:   name,
 			Params: params,
-			Result: MethodSchemaParam{Name: "result", Schema: schema.Get(resultType, h.schemaRoot.Defs)},
+			Result: MethodSchemaParam{Name: "result", Schema: schema.Get(resultType, defs)},
 		}
 	} else {
 		methodSchema = &methodSchemas[0]
 		methodSchema.Name = name
 		methodSchema.Params = params
-		methodSchema.Result = MethodSchemaParam{Name: "result", Schema: schema.Get(resultType, h.schemaRoot.Defs)}
+		methodSchema.Result = MethodSchemaParam{Name: "result", Schema: schema.Get(resultType, defs)}
 	}
 
-	h.Store(name, &methodHandler{
+	return &methodHandler{
 		fn:           fn,
+		withContext:  withContext,
 		inputType:    inputType,
 		resultType:   resultType,
 		methodSchema: methodSchema,
-	})
-
-	h.schemaRoot.Methods = append(h.schemaRoot.Methods, methodSchema)
+	}
 }
 
 func (h *Server) Get(name string) (*methodHandler, error) {
 	method, ok := h.Load(name)
 	if !ok {
+		if builtin := h.getBuiltin(name); builtin != nil {
+			return builtin, nil
+		}
 		return nil, fmt.Errorf("method not found")
 	}
 	method1, ok := method.(*methodHandler)
@@ -149,16 +287,23 @@ func (h *Server) GetAllMethods() []string {
 }
 
 type Input struct {
-	ID      string `json:"id,omitempty"`
-	Method  string `json:"method"`
-	Params  any    `json:"params"`
-	JsonRPC string `json:"jsonrpc,omitempty"`
+	ID          string `json:"id,omitempty"`
+	Method      string `json:"method"`
+	Params      any    `json:"params"`
+	JsonRPC     string `json:"jsonrpc,omitempty"`
+	Traceparent string `json:"traceparent,omitempty"`
+	Tracestate  string `json:"tracestate,omitempty"`
 }
 
 type inputPartial struct {
-	ID     string          `json:"id,omitempty"`
-	Method string          `json:"method"`
-	Params json.RawMessage `json:"params"`
+	ID          string           `json:"id,omitempty"`
+	Method      string           `json:"method"`
+	Params      codec.RawMessage `json:"params"`
+	Traceparent string           `json:"traceparent,omitempty"`
+	Tracestate  string           `json:"tracestate,omitempty"`
+
+	value any  //params passed without encoding by a zero-copy LocalClient
+	local bool //value is used instead of Params
 }
 
 type Output struct {
@@ -178,61 +323,232 @@ func (e *OutputError) Error() string {
 	return string(eJSON)
 }
 
-func (h *Server) handleTCPConnection(connection net.Conn) {
+// ServeConn runs the TCP protocol over any stream until it fails or is closed, then closes it.
+// Read, write and idle timeouts are only applied when connection has deadlines like net.Conn
+func (h *Server) ServeConn(connection io.ReadWriteCloser) {
+	p := &peer{
+		connID:    atomic.AddUint64(&h.connIDs, 1),
+		transport: TransportStream,
+	}
+	if netConn, ok := connection.(net.Conn); ok {
+		p.remoteAddr = netConn.RemoteAddr().String()
+		p.transport = TransportTCP
+	}
+	ctx := withPeer(context.Background(), p)
+	logger := h.logger().With(p.logAttrs()...)
+	logger.Debug("RPCServer connection opened")
+	h.Metrics.add(metricServerConnections, 1)
+	defer h.Metrics.add(metricServerConnections, -1)
+	h.trackConnection(p.connID, connection)
+	defer h.untrackConnection(p.connID)
+	defer connection.Close()
+	var calls atomic.Int64
+	dc := newDeadlineConn(connection, h.ReadTimeout, h.WriteTimeout, h.IdleTimeout, func() bool {
+		return calls.Load() > 0
+	})
+	reader, sess, err := h.handshake(dc)
+	if err != nil {
+		h.connectionClosed(logger, err)
+		return
+	}
+	writer := newFrameWriter(dc, h.WriteQueueSize, h.WriteTimeout)
+	defer writer.close()
+	h.trackWriter(p.connID, writer)
+	hb := startHeartbeat(sess, writer, h.HeartbeatInterval, h.HeartbeatMisses, func() { connection.Close() })
+	defer hb.close()
+	if sess.version > 0 {
+		logger.Debug("RPCServer handshake", "version", sess.version, "codec", sess.codec, "compression", sess.compression)
+	}
+	errTooLarge := func(messageID uint64) outFrame {
+		errBytes, _ := sess.getCodec().Marshal(&Output{Error: errMessageTooLarge})
+		return outFrame{errBytes, packets.TypeMessage, messageID}
+	}
+	frames := packets.NewReader(reader)
+	chunks := newReassembler(h.maxMessageSize())
+	slots := make(chan struct{}, h.maxConnCalls())
 	for {
-		message, messageType, messageID, length, err := packets.Parse(connection)
-		if err != nil {
-			if h.Logging.Includes(LoggingErr) {
-				log.Println("RPCServer packets.Parse", err)
+		if frames.Buffered() == 0 {
+			dc.startFrame()
+		}
+		frame, messageType, messageID, length, err := frames.ReadFrame(h.maxFrameSize())
+		if err == nil {
+			logger.Debug("RPCServer message", LogKeyMessageID, messageID, LogKeyLength, length)
+			h.Metrics.add(metricServerReceived, float64(length+packets.HeaderLength), p.transport)
+			hb.received()
+			if controlFrame(writer, messageType, messageID) {
+				packets.Release(frame)
+				continue
+			}
+			dc.active()
+			if messageType&packets.TypeMask != packets.TypeMessage {
+				logger.Debug("RPCServer message of unknown type skipped", LogKeyMessageID, messageID, "type", messageType)
+				packets.Release(frame)
+				continue
+			}
+			var complete bool
+			frame, messageType, complete, err = chunks.add(frame, messageType, messageID)
+			if errors.Is(err, packets.ErrTooLarge) {
+				logger.Error("RPCServer chunked message too large", LogKeyMessageID, messageID, LogKeyLength, h.maxMessageSize())
+				writer.write(errTooLarge(messageID))
+				continue
 			}
+			if err == nil && !complete {
+				continue
+			}
+		}
+		var message []byte
+		if err == nil {
+			message, err = readFrameBody(frame, messageType, h.maxMessageSize())
+		}
+		if errors.Is(err, packets.ErrTooLarge) {
+			logger.Error("RPCServer message too large", LogKeyMessageID, messageID, LogKeyLength, length)
+			h.Metrics.add(metricServerConnectionsClosed, 1, closeReasonTooLarge)
+			writer.write(errTooLarge(messageID))
+			flushAndClose(writer, connection, h.flushTimeout())
 			return
 		}
-		if h.Logging.Includes(LoggingBase) {
-			log.Printf("RPCServer message: messageID %v; length %v;", messageID, length)
+		if err != nil {
+			h.connectionClosed(logger, hb.err(err))
+			flushAndClose(writer, connection, h.flushTimeout())
+			return
 		}
-		go h.handleTCPConnectionBytes(connection, message, messageType, messageID) //running different calls of single connection in different routines
+		slots <- struct{}{} //stops reading while the connection has MaxConnCalls calls
+		calls.Add(1)
+		h.health.unqueued.Add(1)
+		go func() { //running different calls of single connection in different routines
+			defer func() { <-slots }()
+			defer calls.Add(-1)
+			defer h.health.unqueued.Add(-1)
+			h.handleTCPConnectionBytes(ctx, writer, sess, message, messageType, messageID)
+			packets.Release(message)
+		}()
 	}
 }
 
-func (h *Server) handleTCPConnectionBytes(connection net.Conn, message []byte, messageType uint64, messageID uint64) {
-	r, err := h.HandleBytes(message, messageID, nil)
+// flushTimeout limits flushing the responses of a connection which is closed; a peer which did not read them
+// for WriteTimeout, or IdleTimeout without one, is not waited for any longer
+func (h *Server) flushTimeout() time.Duration {
+	if h.WriteTimeout > 0 {
+		return h.WriteTimeout
+	}
+	if h.IdleTimeout > 0 {
+		return h.IdleTimeout
+	}
+	return closeFlushTimeout
+}
+
+func (h *Server) connectionClosed(logger *slog.Logger, err error) {
+	reason := closeReason(err)
+	h.Metrics.add(metricServerConnectionsClosed, 1, reason)
+	switch reason {
+	case closeReasonEOF:
+		logger.Debug("RPCServer connection closed", "reason", reason)
+	case closeReasonIdle:
+		logger.Info("RPCServer connection closed", "reason", reason)
+	default:
+		logger.Error("RPCServer connection closed", "reason", reason, "err", err)
+	}
+}
+
+// handshake reads the preamble of a connection and answers a versioned one. A legacy connection gets the zero session
+// and a reader returning the bytes consumed while looking for the preamble
+func (h *Server) handshake(dc *deadlineConn) (io.Reader, *session, error) {
+	preamble := make([]byte, packets.PreambleLength)
+	if _, err := io.ReadFull(dc, preamble); err != nil {
+		return nil, nil, err
+	}
+	version, err := packets.ParsePreamble(preamble)
 	if err != nil {
-		if h.Logging.Includes(LoggingErr) {
-			log.Println("RPCServer HandleBytes", err)
+		if h.RequireHandshake {
+			return nil, nil, fmt.Errorf("%w: %v", ErrProtocol, err)
 		}
-		errJSON, _ := json.Marshal(map[string]any{"error": err.Error(), "messageID": messageID})
-		connection.Write(packets.Create(errJSON, messageType, messageID))
-	} else {
-		connection.Write(packets.Create(r, messageType, messageID))
+		return &prefixReader{Reader: dc, prefix: preamble}, &session{}, nil
+	}
+	dc.startFrame()
+	clientHello, err := packets.ParseHello(dc, h.maxFrameSize())
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrProtocol, err)
+	}
+	sess, serverHello := negotiate(version, clientHello, localHello(h.maxFrameSize(), !h.DisableCompression, nil))
+	frame, err := packets.CreateHello(sess.version, serverHello)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := dc.Write(frame); err != nil {
+		return nil, nil, err
+	}
+	return dc, sess, nil
+}
+
+func (h *Server) handleTCPConnectionBytes(ctx context.Context, writer *frameWriter, sess *session, message []byte, messageType uint64, messageID uint64) {
+	c := sess.getCodec()
+	r, err := h.handleBytes(ctx, c, message, messageID, nil)
+	if err != nil {
+		h.logger().Error("RPCServer HandleBytes", append(peerFromContext(ctx).logAttrs(), LogKeyMessageID, messageID, "err", err)...)
+		r, _ = c.Marshal(&Output{Error: toOutputError(err)})
+	}
+	frames := createFrames(sess, r, messageType&packets.TypeMask, messageID, h.CompressionThreshold, h.ChunkSize)
+	n, err := writeFrames(writer, frames)
+	h.Metrics.add(metricServerSent, float64(n), peerFromContext(ctx).transport)
+	if err != nil {
+		h.logger().Error("RPCServer write", append(peerFromContext(ctx).logAttrs(), LogKeyMessageID, messageID, "err", err)...)
 	}
 }
 
 func (h *Server) HandleBytes(bodyBytes []byte, messageID uint64, middlewareFn func(reflect.Value)) ([]byte, error) {
+	return h.handleBytes(context.Background(), codec.JSON, bodyBytes, messageID, middlewareFn)
+}
+
+// HandleBytesCodec is HandleBytes for messages encoded with c
+func (h *Server) HandleBytesCodec(c codec.Codec, bodyBytes []byte, messageID uint64, middlewareFn func(reflect.Value)) ([]byte, error) {
+	return h.handleBytes(context.Background(), c, bodyBytes, messageID, middlewareFn)
+}
+
+func (h *Server) handleBytes(ctx context.Context, c codec.Codec, bodyBytes []byte, messageID uint64, middlewareFn func(reflect.Value)) ([]byte, error) {
+	results, arrayInput, err := h.handleMessage(ctx, c, bodyBytes, messageID, middlewareFn)
+	if err != nil {
+		return nil, err
+	}
+	return marshalResults(c, results, arrayInput)
+}
+
+// handleMessage runs the calls of a message, a batch when arrayInput, and returns their outputs in input order
+func (h *Server) handleMessage(ctx context.Context, c codec.Codec, bodyBytes []byte, messageID uint64, middlewareFn func(reflect.Value)) ([]*Output, bool, error) {
 	if len(bodyBytes) == 0 {
-		return nil, fmt.Errorf("zero bytes handled")
+		return nil, false, &OutputError{Code: ErrorCodeInvalidRequest, Message: "zero bytes handled"}
 	}
 	var input []*inputPartial
 	var arrayInput bool
 
-	if bodyBytes[0] == 91 { //'['
-		err := json.Unmarshal(bodyBytes, &input)
+	if c.IsArray(bodyBytes) {
+		err := c.Unmarshal(bodyBytes, &input)
 		if err != nil {
-			return nil, err
+			return nil, false, &OutputError{Code: ErrorCodeParse, Message: err.Error()}
 		}
 		if len(input) == 0 { //skip wg and avoid json.Marshal panic with nil input
-			return []byte("[]"), nil
+			return []*Output{}, true, nil
 		}
 		arrayInput = true
-	} else if bodyBytes[0] == 123 { //'{'
+	} else {
 		input1 := &inputPartial{}
-		err := json.Unmarshal(bodyBytes, input1)
+		err := c.Unmarshal(bodyBytes, input1)
 		if err != nil {
-			return nil, err
+			return nil, false, &OutputError{Code: ErrorCodeParse, Message: err.Error()}
 		}
 		input = append(input, input1)
-	} else {
-		return nil, fmt.Errorf("firstSymbol is not a json part")
 	}
+	return h.handleInputs(ctx, c, messageID, input, arrayInput, middlewareFn), arrayInput, nil
+}
+
+// handleInputs runs the calls of a message concurrently and returns their outputs in input order
+func (h *Server) handleInputs(ctx context.Context, c codec.Codec, messageID uint64, input []*inputPartial, arrayInput bool, middlewareFn func(reflect.Value)) []*Output {
+	h.health.calls.Add(1)
+	defer h.health.calls.Add(-1)
+	logger := h.logger().With(peerFromContext(ctx).logAttrs()...)
+	if arrayInput {
+		logger.Debug("RPCServer batch", LogKeyMessageID, messageID, LogKeyBatchSize, len(input))
+	}
+	h.Metrics.observe(metricServerBatchSize, float64(len(input)))
 
 	wg := sync.WaitGroup{}
 	wg.Add(len(input))
@@ -240,69 +556,112 @@ func (h *Server) HandleBytes(bodyBytes []byte, messageID uint64, middlewareFn fu
 	for i, inputItem := range input {
 		go func(i int, inputItem *inputPartial) {
 			defer wg.Done()
-			if h.Logging.Includes(LoggingBase) {
-				log.Printf("RPCServer method: %v; messageID: %v", inputItem.Method, messageID)
-			}
-			output := &Output{ID: inputItem.ID}
-			results[i] = output
-
-			method, err := h.Get(inputItem.Method)
-			if err != nil {
-				output.Error = &OutputError{Message: err.Error()}
-				return
-			}
-
-			var methodOut []reflect.Value
-			if method.inputType == nil {
-				methodOut = reflect.ValueOf(method.fn).Call(nil)
-			} else {
-				params, err := method.unmarshalInput(inputItem.Params)
-				if err != nil {
-					output.Error = &OutputError{Message: err.Error()}
-					return
-				}
-				if middlewareFn != nil {
-					middlewareFn(params)
-				}
-				methodOut = reflect.ValueOf(method.fn).Call([]reflect.Value{params})
-			}
-			if len(methodOut) > 0 {
-				output.Result = methodOut[0].Interface()
-			}
-			if len(methodOut) > 1 {
-				errInterface := methodOut[1].Interface()
-				if errInterface != nil {
-					err1, ok := errInterface.(*OutputError)
-					if ok {
-						output.Error = err1
-					} else {
-						err, ok := errInterface.(error)
-						if ok {
-							output.Error = &OutputError{Message: err.Error()}
-						}
-					}
-					if h.Logging.Includes(LoggingErr) {
-						log.Printf("RPCServer method: %v; messageID: %v; err: %v", inputItem.Method, messageID, errInterface)
-					}
-					return
-				}
-			}
+			results[i] = h.handleInput(ctx, c, logger, messageID, inputItem, middlewareFn)
 		}(i, inputItem)
 	}
 	wg.Wait()
+	return results
+}
 
+func marshalResults(c codec.Codec, results []*Output, arrayInput bool) ([]byte, error) {
+	var resultBytes []byte
+	var err error
 	if arrayInput {
-		resultJSON, err := json.Marshal(results)
-		if err != nil {
-			return nil, err
+		resultBytes, err = c.Marshal(results)
+	} else {
+		resultBytes, err = c.Marshal(results[0])
+	}
+	if err != nil {
+		return nil, &OutputError{Code: ErrorCodeInternal, Message: err.Error()}
+	}
+	return resultBytes, nil
+}
+
+func (h *Server) handleInput(ctx context.Context, c codec.Codec, logger *slog.Logger, messageID uint64, inputItem *inputPartial, middlewareFn func(reflect.Value)) *Output {
+	output := &Output{ID: inputItem.ID}
+	start := time.Now()
+	methodLabel := metricLabelUnknownMethod
+	callCtx := ctx
+	if inputItem.Traceparent != "" {
+		if tc, err := ParseTraceparent(inputItem.Traceparent, inputItem.Tracestate); err == nil {
+			callCtx = ContextWithTrace(callCtx, tc)
 		}
-		return resultJSON, nil
 	}
-	resultJSON, err := json.Marshal(results[0])
+	var span Span
+	if h.Tracer != nil {
+		callCtx, span = h.Tracer.Start(callCtx, inputItem.Method)
+	}
+	defer func() {
+		duration := time.Since(start)
+		code := metricLabelCodeOK
+		attrs := []any{LogKeyMethod, inputItem.Method, LogKeyMessageID, messageID, LogKeyDuration, duration}
+		if output.Error != nil {
+			code = strconv.FormatInt(output.Error.Code, 10)
+			logger.Warn("RPCServer call failed", append(attrs, LogKeyCode, output.Error.Code, "err", output.Error.Message)...)
+		} else {
+			logger.Debug("RPCServer call", attrs...)
+		}
+		h.Metrics.add(metricServerRequests, 1, methodLabel, code)
+		h.Metrics.observe(metricServerDuration, duration.Seconds(), methodLabel)
+		if span != nil {
+			if output.Error != nil {
+				span.SetError(output.Error)
+			}
+			span.End()
+		}
+	}()
+
+	method, err := h.Get(inputItem.Method)
 	if err != nil {
-		return nil, err
+		output.Error = &OutputError{Code: ErrorCodeMethodNotFound, Message: err.Error()}
+		return output
+	}
+	methodLabel = inputItem.Method
+	h.Metrics.add(metricServerInFlight, 1, methodLabel)
+	defer h.Metrics.add(metricServerInFlight, -1, methodLabel)
+	callCtx, done := h.startInflight(callCtx, c, messageID, inputItem)
+	defer done()
+
+	var args []reflect.Value
+	if method.withContext {
+		args = append(args, reflect.ValueOf(callCtx))
+	}
+	if method.inputType != nil {
+		var params reflect.Value
+		if inputItem.local {
+			params, err = method.valueInput(inputItem.value)
+		} else {
+			params, err = method.unmarshalInput(c, inputItem.Params)
+		}
+		if err != nil {
+			output.Error = &OutputError{Code: ErrorCodeInvalidParams, Message: err.Error()}
+			return output
+		}
+		if middlewareFn != nil {
+			middlewareFn(params)
+		}
+		args = append(args, params)
+	}
+	methodOut := reflect.ValueOf(method.fn).Call(args)
+	if len(methodOut) > 0 {
+		output.Result = methodOut[0].Interface()
 	}
-	return resultJSON, nil
+	if len(methodOut) > 1 {
+		errInterface := methodOut[1].Interface()
+		if errInterface != nil {
+			err1, ok := errInterface.(*OutputError)
+			if ok {
+				output.Error = err1
+			} else {
+				err, ok := errInterface.(error)
+				if ok {
+					output.Error = &OutputError{Code: ErrorCodeServer, Message: err.Error()}
+				}
+			}
+			return output
+		}
+	}
+	return output
 }
 
 func (h *Server) HandleOpenRPCSchema(w http.ResponseWriter, r *http.Request) {
@@ -311,7 +670,7 @@ func (h *Server) HandleOpenRPCSchema(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("{}"))
 		return
 	}
-	resultJSON, err := json.MarshalIndent(h.schemaRoot, "", "  ")
+	resultJSON, err := json.MarshalIndent(h.getSchemaRoot(), "", "  ")
 	if err != nil {
 		SendAPIError(w, err)
 		return
@@ -327,35 +686,97 @@ func (h *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if r.Method == "POST" {
-		bodyBytes, err := io.ReadAll(r.Body)
 		defer r.Body.Close()
+		body := &countingReader{r: http.MaxBytesReader(w, r.Body, h.maxBodySize())}
+		var bodyBytes []byte
+		var err error
+		switch r.Header.Get("Content-Encoding") {
+		case "", "identity":
+			bodyBytes, err = io.ReadAll(body)
+		case CompressionGzip:
+			if h.DisableCompression {
+				sendOutputError(w, http.StatusUnsupportedMediaType, &OutputError{Code: ErrorCodeInvalidRequest, Message: "unsupported Content-Encoding"})
+				return
+			}
+			bodyBytes, err = gzipDecompress(body, uint64(h.maxBodySize()))
+		default:
+			sendOutputError(w, http.StatusUnsupportedMediaType, &OutputError{Code: ErrorCodeInvalidRequest, Message: "unsupported Content-Encoding"})
+			return
+		}
+		h.Metrics.add(metricServerReceived, float64(body.n), TransportHTTP)
 		if err != nil {
+			maxBytesErr := &http.MaxBytesError{}
+			if errors.As(err, &maxBytesErr) || errors.Is(err, packets.ErrTooLarge) {
+				h.logger().Error("RPCServer body too large", LogKeyTransport, TransportHTTP, LogKeyRemoteAddr, r.RemoteAddr, LogKeyLength, r.ContentLength)
+				sendOutputError(w, http.StatusRequestEntityTooLarge, errMessageTooLarge)
+				return
+			}
+			if errors.Is(err, ErrProtocol) {
+				sendOutputError(w, http.StatusBadRequest, &OutputError{Code: ErrorCodeParse, Message: err.Error()})
+				return
+			}
 			SendAPIError(w, err)
 			return
 		}
 
-		resultJSON, err := h.HandleBytes(bodyBytes, 0, func(params reflect.Value) {
+		ctx := withPeer(r.Context(), &peer{remoteAddr: r.RemoteAddr, transport: TransportHTTP})
+		if traceparent := r.Header.Get(HeaderTraceparent); traceparent != "" {
+			if tc, err := ParseTraceparent(traceparent, r.Header.Get(HeaderTracestate)); err == nil {
+				ctx = ContextWithTrace(ctx, tc)
+			}
+		}
+		c := codec.ByContentType(r.Header.Get("Content-Type"))
+		if c == nil { //browsers and older clients send anything, they all use JSON
+			c = codec.JSON
+		}
+		resultBytes, err := h.handleBytes(ctx, c, bodyBytes, 0, func(params reflect.Value) {
 			headerField, headerFieldOk := GetStructFieldByName(params, "Header")
 			if headerFieldOk && headerField.Type() == reflect.TypeOf(http.Header{}) {
 				headerField.Set(reflect.ValueOf(r.Header))
 			}
 		})
 		if err != nil {
-			if h.Logging.Includes(LoggingErr) {
-				log.Println("RPCServer HandleBytes", err)
+			h.logger().Error("RPCServer HandleBytes", LogKeyTransport, TransportHTTP, LogKeyRemoteAddr, r.RemoteAddr, "err", err)
+			outputError := toOutputError(err)
+			status := http.StatusInternalServerError
+			if outputError.Code == ErrorCodeParse || outputError.Code == ErrorCodeInvalidRequest {
+				status = http.StatusBadRequest
 			}
-			SendAPIError(w, err)
+			sendOutputError(w, status, outputError)
 			return
 		}
-		w.Write(resultJSON)
+		if c != codec.JSON {
+			w.Header().Set("Content-Type", c.ContentType())
+		}
+		if !h.DisableCompression && len(resultBytes) >= compressionThreshold(h.CompressionThreshold) && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			if compressed, err := gzipCompress(resultBytes); err == nil {
+				w.Header().Set("Content-Encoding", CompressionGzip)
+				resultBytes = compressed
+			}
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		n, _ := w.Write(resultBytes)
+		h.Metrics.add(metricServerSent, float64(n), TransportHTTP)
 		return
 	}
 	SendAPIError(w, fmt.Errorf("not implemented"))
 }
 
+// HandleMetrics writes Server.Metrics in Prometheus text format
+func (h *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	h.Metrics.ServeHTTP(w, r)
+}
+
 func (h *Server) ListenHTTP(port string) error {
 	http.HandleFunc("/api/rpc", h.HandleHTTP)
-	log.Println("RPCServer.ListenHTTP", port)
+	if h.HealthRoutes {
+		http.HandleFunc("/healthz", h.HandleHealthz)
+		http.HandleFunc("/readyz", h.HandleReadyz)
+	}
+	if h.Metrics != nil {
+		http.HandleFunc("/metrics", h.HandleMetrics)
+	}
+	h.logger().Info("RPCServer.ListenHTTP", LogKeyTransport, TransportHTTP, "port", port)
 	err := http.ListenAndServe(":"+port, nil)
 	if err != nil {
 		return err
@@ -363,32 +784,83 @@ func (h *Server) ListenHTTP(port string) error {
 	return nil
 }
 
+// ListenTCP serves TCP connections on port of all IPv4 interfaces
 func (h *Server) ListenTCP(port string) error {
 	l, err := net.Listen("tcp4", ":"+port)
 	if err != nil {
 		return err
 	}
+	return h.Serve(l)
+}
+
+// ListenTCPAddr serves TCP connections on addr, like "127.0.0.1:8001" or "[::1]:0"; Addr reports the port picked for port 0
+func (h *Server) ListenTCPAddr(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return h.Serve(l)
+}
+
+// Serve accepts connections on l and serves each with ServeConn until l fails or CloseTCP or Shutdown closes it,
+// which returns nil. l is closed on return
+func (h *Server) Serve(l net.Listener) error {
+	h.listenerMu.Lock()
 	h.listener = l
-	h.closed = false
-	log.Println("RPCServer.ListenTCP", port)
-	defer h.listener.Close()
+	h.listenerMu.Unlock()
+	h.logger().Info("RPCServer.Serve", LogKeyTransport, TransportTCP, "addr", l.Addr().String())
+	defer func() {
+		l.Close()
+		h.listenerMu.Lock()
+		if h.listener == l {
+			h.listener = nil
+		}
+		h.listenerMu.Unlock()
+	}()
+	var delay time.Duration
 	for {
-		if h.listener == nil {
-			return fmt.Errorf("listener not exists")
+		connection, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
 		}
-		connection, err := h.listener.Accept()
 		if err != nil {
-			if h.Logging.Includes(LoggingErr) {
-				log.Println("connection accept error", err)
+			if !isTemporary(err) {
+				return err
 			}
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			h.logger().Error("RPCServer connection accept", "err", err, "retryIn", delay)
+			time.Sleep(delay)
 			continue
 		}
-		go h.handleTCPConnection(connection)
+		delay = 0
+		go h.ServeConn(connection)
 	}
 }
 
+// Addr is the address of the listener Serve is using, nil when not listening
+func (h *Server) Addr() net.Addr {
+	h.listenerMu.Lock()
+	defer h.listenerMu.Unlock()
+	if h.listener == nil {
+		return nil
+	}
+	return h.listener.Addr()
+}
+
+// CloseTCP stops accepting TCP connections; open ones are left running
 func (h *Server) CloseTCP() error {
-	err := h.listener.Close()
+	h.listenerMu.Lock()
+	l := h.listener
 	h.listener = nil
-	return err
+	h.listenerMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
+
+// isTemporary reports accept errors like running out of file descriptors, which go away
+func isTemporary(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
 }
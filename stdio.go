@@ -0,0 +1,350 @@
+package rpc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/namitos/rpc/codec"
+	"github.com/namitos/rpc/packets"
+)
+
+// ServeStdio serves JSON-RPC on stdin and stdout until stdin is closed, for a process started by NewCommandClient.
+// Nothing else may write to stdout; log to stderr instead
+func (h *Server) ServeStdio() error {
+	return h.ServeStream(os.Stdin, os.Stdout)
+}
+
+// ServeStream serves JSON messages framed with Content-Length headers, read from r and answered on w.
+// Messages are handled concurrently like on TCP connections; items without an ID are notifications and get no response,
+// unlike on TCP, where the frame ID answers every message. A message which cannot be handled at all is answered with an
+// error without ID. It returns nil when r ends, once running calls are answered
+func (h *Server) ServeStream(r io.Reader, w io.Writer) error {
+	p := &peer{
+		connID:    atomic.AddUint64(&h.connIDs, 1),
+		transport: TransportStdio,
+	}
+	ctx := withPeer(context.Background(), p)
+	logger := h.logger().With(p.logAttrs()...)
+	logger.Debug("RPCServer stream opened")
+	out := &streamWriter{w: w}
+	reader := bufio.NewReader(r)
+	var calls sync.WaitGroup
+	defer calls.Wait()
+	for messageID := uint64(1); ; messageID++ {
+		message, err := packets.ReadContentLength(reader, h.maxFrameSize())
+		if errors.Is(err, packets.ErrTooLarge) {
+			logger.Error("RPCServer message too large", LogKeyMessageID, messageID, LogKeyLength, h.maxFrameSize())
+			errBytes, _ := codec.JSON.Marshal(&Output{Error: errMessageTooLarge})
+			out.write(errBytes)
+			return err
+		}
+		if errors.Is(err, io.EOF) {
+			logger.Debug("RPCServer stream closed")
+			return nil
+		}
+		if err != nil {
+			logger.Error("RPCServer stream closed", "err", err)
+			return err
+		}
+		logger.Debug("RPCServer message", LogKeyMessageID, messageID, LogKeyLength, len(message))
+		h.Metrics.add(metricServerReceived, float64(len(message)), TransportStdio)
+		calls.Add(1)
+		go func(messageID uint64) {
+			defer calls.Done()
+			h.handleStreamMessage(ctx, out, message, messageID)
+		}(messageID)
+	}
+}
+
+func (h *Server) handleStreamMessage(ctx context.Context, out *streamWriter, message []byte, messageID uint64) {
+	c := codec.JSON
+	var r []byte
+	results, arrayInput, err := h.handleMessage(ctx, c, message, messageID, nil)
+	if err == nil {
+		answered := withoutNotifications(results)
+		if len(answered) == 0 && len(results) > 0 {
+			return
+		}
+		r, err = marshalResults(c, answered, arrayInput)
+	}
+	if err != nil {
+		h.logger().Error("RPCServer HandleBytes", append(peerFromContext(ctx).logAttrs(), LogKeyMessageID, messageID, "err", err)...)
+		r, _ = c.Marshal(&Output{Error: toOutputError(err)})
+	}
+	n, err := out.write(r)
+	h.Metrics.add(metricServerSent, float64(n), TransportStdio)
+	if err != nil {
+		h.logger().Error("RPCServer write", append(peerFromContext(ctx).logAttrs(), LogKeyMessageID, messageID, "err", err)...)
+	}
+}
+
+// withoutNotifications drops the outputs of items sent without an ID
+func withoutNotifications(results []*Output) []*Output {
+	answered := make([]*Output, 0, len(results))
+	for _, output := range results {
+		if output.ID != "" {
+			answered = append(answered, output)
+		}
+	}
+	return answered
+}
+
+// streamWriter writes whole Content-Length framed messages for concurrent callers
+type streamWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func (s *streamWriter) write(message []byte) (int, error) {
+	frame := packets.CreateContentLength(message)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(frame)
+}
+
+// NewStdioClient calls the server answering on r the messages written to w and reads its responses in the background
+func NewStdioClient(r io.Reader, w io.Writer) *StdioClient {
+	client := &StdioClient{Reader: r, Writer: w}
+	client.done = make(chan struct{})
+	go client.run()
+	return client
+}
+
+// NewCommandClient starts cmd and calls the Server.ServeStdio running in it. Close stops the process by closing its stdin
+func NewCommandClient(cmd *exec.Cmd) (*StdioClient, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	client := NewStdioClient(stdout, stdin)
+	client.cmd = cmd
+	return client, nil
+}
+
+// StdioClient calls a Server.ServeStream peer over a pair of streams, usually the stdin and stdout of a subprocess.
+// Calls run concurrently; every item is sent with an ID of the client, which matches responses by it,
+// and the output gets the ID of the input back. An error response without ID cannot be matched, so it fails every waiting call
+type StdioClient struct {
+	Reader io.Reader
+	Writer io.Writer
+	// Logger receives the end of the stream; nothing is logged when nil
+	Logger *slog.Logger
+	// Metrics counts traffic when set
+	Metrics *Metrics
+	// MaxMessageSize limits responses, DefaultMaxMessageSize when 0; an oversized response stops the client
+	MaxMessageSize uint64
+
+	waitingResponses   map[string]chan tcpResponse
+	waitingResponsesMu sync.Mutex
+	counter            uint64
+	err                error
+	writeMu            sync.Mutex
+	cmd                *exec.Cmd
+	done               chan struct{}
+}
+
+func (h *StdioClient) logger() *slog.Logger {
+	return loggerOrDiscard(h.Logger)
+}
+
+func (h *StdioClient) maxMessageSize() uint64 {
+	if h.MaxMessageSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	return h.MaxMessageSize
+}
+
+func (h *StdioClient) run() {
+	defer close(h.done)
+	h.Run()
+}
+
+// Run reads responses until Reader fails; calls waiting then, and all later ones, fail with ErrDisconnected.
+// NewStdioClient runs it already
+func (h *StdioClient) Run() error {
+	reader := bufio.NewReader(h.Reader)
+	for {
+		message, err := packets.ReadContentLength(reader, h.maxMessageSize())
+		if err != nil {
+			h.logger().Info("StdioClient stopped", "err", err)
+			h.stop(err)
+			return err
+		}
+		h.Metrics.add(metricClientReceived, float64(len(message)), TransportStdio)
+		h.deliverResponse(message)
+	}
+}
+
+func (h *StdioClient) stop(err error) {
+	h.waitingResponsesMu.Lock()
+	h.err = err
+	h.waitingResponsesMu.Unlock()
+	h.failWaitingResponses(fmt.Errorf("%w: %v", ErrDisconnected, err))
+}
+
+type responseID struct {
+	ID    string       `json:"id"`
+	Error *OutputError `json:"error"`
+}
+
+// deliverResponse hands a response to the call which sent the item of its first ID
+func (h *StdioClient) deliverResponse(message []byte) {
+	var ids []responseID
+	if codec.JSON.IsArray(message) {
+		json.Unmarshal(message, &ids)
+	} else {
+		ids = make([]responseID, 1)
+		json.Unmarshal(message, &ids[0])
+	}
+	if len(ids) == 1 && ids[0].ID == "" && ids[0].Error != nil {
+		h.logger().Warn("StdioClient error without ID fails all waiting calls", "err", ids[0].Error)
+		h.failWaitingResponses(ids[0].Error)
+		return
+	}
+	if len(ids) == 0 || ids[0].ID == "" {
+		h.logger().Warn("StdioClient response without ID dropped", LogKeyLength, len(message))
+		return
+	}
+	h.waitingResponsesMu.Lock()
+	channel := h.waitingResponses[ids[0].ID]
+	delete(h.waitingResponses, ids[0].ID)
+	h.waitingResponsesMu.Unlock()
+	if channel != nil {
+		channel <- tcpResponse{body: message}
+	}
+}
+
+func (h *StdioClient) failWaitingResponses(err error) {
+	h.waitingResponsesMu.Lock()
+	defer h.waitingResponsesMu.Unlock()
+	for id, channel := range h.waitingResponses {
+		delete(h.waitingResponses, id)
+		channel <- tcpResponse{err: err}
+	}
+}
+
+func (h *StdioClient) write(body []byte) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	n, err := h.Writer.Write(packets.CreateContentLength(body))
+	h.Metrics.add(metricClientSent, float64(n), TransportStdio)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	return nil
+}
+
+func (h *StdioClient) Call(ctx context.Context, input []Input, result *[]Output) error {
+	if len(input) == 0 {
+		return nil
+	}
+	if tc, ok := TraceFromContext(ctx); ok {
+		input = withTrace(input, tc)
+	}
+	items := make([]Input, len(input))
+	channel := make(chan tcpResponse, 1)
+	h.waitingResponsesMu.Lock()
+	if h.err != nil {
+		h.waitingResponsesMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrDisconnected, h.err)
+	}
+	for i, item := range input {
+		h.counter++
+		item.ID = strconv.FormatUint(h.counter, 10)
+		items[i] = item
+	}
+	callID := items[0].ID
+	if h.waitingResponses == nil {
+		h.waitingResponses = map[string]chan tcpResponse{}
+	}
+	h.waitingResponses[callID] = channel
+	h.waitingResponsesMu.Unlock()
+	forget := func() {
+		h.waitingResponsesMu.Lock()
+		delete(h.waitingResponses, callID)
+		h.waitingResponsesMu.Unlock()
+	}
+	body, err := json.Marshal(items)
+	if err == nil {
+		err = h.write(body)
+	}
+	if err != nil {
+		forget()
+		return err
+	}
+	select {
+	case response := <-channel:
+		if response.err != nil {
+			return response.err
+		}
+		if err := unmarshalOutput(codec.JSON, response.body, result); err != nil {
+			return err
+		}
+		for i := range *result {
+			if i < len(input) {
+				(*result)[i].ID = input[i].ID
+			}
+		}
+		return nil
+	case <-ctx.Done():
+		forget()
+		return contextError(ctx)
+	}
+}
+
+func (h *StdioClient) CallSingle(ctx context.Context, method string, params any, result any) error {
+	return CallSingle(h, ctx, method, params, result)
+}
+
+// Notify calls method without an ID, so the server sends no response
+func (h *StdioClient) Notify(ctx context.Context, method string, params any) error {
+	input := Input{Method: method, Params: params}
+	if tc, ok := TraceFromContext(ctx); ok {
+		input.Traceparent = tc.Traceparent()
+		input.Tracestate = tc.State
+	}
+	h.waitingResponsesMu.Lock()
+	err := h.err
+	h.waitingResponsesMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	return h.write(body)
+}
+
+// Close closes Writer when it is an io.Closer, which ends ServeStream on the other side.
+// For NewCommandClient it then waits for the process to exit
+func (h *StdioClient) Close() error {
+	var err error
+	if closer, ok := h.Writer.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if h.cmd != nil {
+		<-h.done
+		if waitErr := h.cmd.Wait(); err == nil {
+			err = waitErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// W3C Trace Context header names; TCPClient sends the same values in Input.Traceparent and Input.Tracestate
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+)
+
+// TraceContext is a W3C trace context: https://www.w3.org/TR/trace-context/
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	State   string
+}
+
+// ParseTraceparent parses traceparent and keeps tracestate as is
+func ParseTraceparent(traceparent, tracestate string) (TraceContext, error) {
+	tc := TraceContext{State: tracestate}
+	if len(traceparent) < 55 || traceparent[2] != '-' || traceparent[35] != '-' || traceparent[52] != '-' {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	version, err := hex.DecodeString(traceparent[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(traceparent) != 55) {
+		return tc, fmt.Errorf("invalid traceparent version %q", traceparent)
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(traceparent[3:35])); err != nil {
+		return tc, fmt.Errorf("invalid trace-id: %w", err)
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(traceparent[36:52])); err != nil {
+		return tc, fmt.Errorf("invalid parent-id: %w", err)
+	}
+	flags, err := hex.DecodeString(traceparent[53:55])
+	if err != nil {
+		return tc, fmt.Errorf("invalid trace-flags: %w", err)
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return tc, fmt.Errorf("invalid traceparent %q", traceparent)
+	}
+	return tc, nil
+}
+
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+func (tc TraceContext) IsSampled() bool {
+	return tc.Flags&1 == 1
+}
+
+// Traceparent formats the context as a version 00 traceparent value
+func (tc TraceContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID, tc.SpanID, tc.Flags)
+}
+
+// NewChild returns a context of the same trace with a new random span ID; a new trace is started for an invalid context
+func (tc TraceContext) NewChild() TraceContext {
+	if tc.TraceID == [16]byte{} {
+		rand.Read(tc.TraceID[:])
+		tc.Flags = 1
+	}
+	rand.Read(tc.SpanID[:])
+	return tc
+}
+
+type traceKey struct{}
+
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(TraceContext)
+	return tc, ok && tc.IsValid()
+}
+
+// Tracer starts spans around Server calls. Start should store the span's TraceContext in the returned context
+// with ContextWithTrace, so outgoing calls made by the handler with it continue the trace
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetError(err error)
+	End()
+}
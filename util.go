@@ -11,19 +11,28 @@ func setDefaultHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 }
 
+// SendAPIError answers err as a JSON-RPC error; an OutputError is sent as it is, others with ErrorCodeInternal
 func SendAPIError(w http.ResponseWriter, err error) {
 	setDefaultHeaders(w)
 	errTxt := err.Error()
-	output, _ := json.Marshal(Output{
-		Error: &OutputError{Message: errTxt},
-	})
+	outputError := toOutputError(err)
 	status := http.StatusInternalServerError
 	if errTxt == "not implemented" {
 		status = http.StatusNotImplemented
+		outputError.Code = ErrorCodeInvalidRequest
 	}
 	if errTxt == "forbidden" {
 		status = http.StatusForbidden
+		outputError.Code = ErrorCodeInvalidRequest
 	}
+	output, _ := json.Marshal(Output{Error: outputError})
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+func sendOutputError(w http.ResponseWriter, status int, outputError *OutputError) {
+	setDefaultHeaders(w)
+	output, _ := json.Marshal(Output{Error: outputError})
 	w.WriteHeader(status)
 	w.Write(output)
 }
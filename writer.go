@@ -0,0 +1,168 @@
+package rpc
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/namitos/rpc/packets"
+)
+
+// DefaultWriteQueueSize is the number of frames a connection buffers for writing unless configured otherwise
+const DefaultWriteQueueSize = 64
+
+// DefaultQueueFullTimeout is how long a write waits for space in a full queue before the connection is closed,
+// when no WriteTimeout is configured
+const DefaultQueueFullTimeout = 30 * time.Second
+
+// closeFlushTimeout limits flushing the last frames of a connection closed by the server without write or idle timeouts
+const closeFlushTimeout = 5 * time.Second
+
+var (
+	ErrWriterClosed   = errors.New("connection writer closed")
+	ErrWriteQueueFull = errors.New("connection write queue full")
+)
+
+// outFrame is a frame waiting to be written; its header is only put together in the write buffer
+type outFrame struct {
+	body        []byte
+	messageType uint64
+	messageID   uint64
+}
+
+func (f outFrame) length() int {
+	return packets.HeaderLength + len(f.body)
+}
+
+// frameWriter is the only writer of a connection. Frames are queued and written by a single goroutine,
+// which coalesces everything queued so far into one flush. When the queue is full write blocks;
+// after fullTimeout, DefaultQueueFullTimeout when 0, it gives up and closes the connection
+type frameWriter struct {
+	connection  io.WriteCloser
+	queue       chan outFrame
+	fullTimeout time.Duration
+	closing     chan struct{}
+	stopped     chan struct{}
+	closeOnce   sync.Once
+	err         error
+	errMu       sync.Mutex
+}
+
+func newFrameWriter(connection io.WriteCloser, queueSize int, fullTimeout time.Duration) *frameWriter {
+	if queueSize <= 0 {
+		queueSize = DefaultWriteQueueSize
+	}
+	if fullTimeout <= 0 {
+		fullTimeout = DefaultQueueFullTimeout
+	}
+	w := &frameWriter{
+		connection:  connection,
+		queue:       make(chan outFrame, queueSize),
+		fullTimeout: fullTimeout,
+		closing:     make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *frameWriter) run() {
+	defer close(w.stopped)
+	bw := packets.NewWriter(w.connection)
+	for {
+		select {
+		case frame := <-w.queue:
+			if err := w.writeQueued(bw, frame); err != nil {
+				w.fail(err)
+				return
+			}
+		case <-w.closing:
+			for {
+				select {
+				case frame := <-w.queue:
+					if err := bw.WriteFrame(frame.body, frame.messageType, frame.messageID); err != nil {
+						return
+					}
+				default:
+					bw.Flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeQueued writes frame and everything queued behind it, then flushes
+func (w *frameWriter) writeQueued(bw *packets.Writer, frame outFrame) error {
+	for {
+		if err := bw.WriteFrame(frame.body, frame.messageType, frame.messageID); err != nil {
+			return err
+		}
+		select {
+		case frame = <-w.queue:
+			continue
+		default:
+		}
+		return bw.Flush()
+	}
+}
+
+func (w *frameWriter) write(frame outFrame) error {
+	select {
+	case <-w.closing:
+		return w.closeErr()
+	default:
+	}
+	select {
+	case w.queue <- frame:
+		return nil
+	default:
+	}
+	timer := time.NewTimer(w.fullTimeout)
+	defer timer.Stop()
+	select {
+	case w.queue <- frame:
+		return nil
+	case <-w.closing:
+		return w.closeErr()
+	case <-timer.C:
+		w.fail(ErrWriteQueueFull)
+		return ErrWriteQueueFull
+	}
+}
+
+// fail stops the writer and closes the connection, which also stops its reader
+func (w *frameWriter) fail(err error) {
+	w.closeWith(err)
+	w.connection.Close()
+}
+
+// close stops accepting frames and flushes the queued ones
+func (w *frameWriter) close() {
+	w.closeWith(ErrWriterClosed)
+	<-w.stopped
+}
+
+// flushAndClose flushes writer and closes connection, also when the peer does not read the frames within timeout
+func flushAndClose(writer *frameWriter, connection io.Closer, timeout time.Duration) {
+	timer := time.AfterFunc(timeout, func() { connection.Close() })
+	writer.close()
+	timer.Stop()
+	connection.Close()
+}
+
+func (w *frameWriter) closeWith(err error) {
+	w.closeOnce.Do(func() {
+		w.errMu.Lock()
+		w.err = err
+		w.errMu.Unlock()
+		close(w.closing)
+	})
+}
+
+func (w *frameWriter) closeErr() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}